@@ -0,0 +1,318 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// osRename is a seam over the renames of the atomic writes, so that tests can inject failures.
+var osRename = os.Rename
+
+// WriteFileAtomic writes |data| to |path| atomically: the data is written and synced to a temporary
+// file in the same directory, which is then renamed over |path|. Readers either see the old content
+// or the new one, never a partial write.
+func WriteFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	return WriteFileAtomicAdvanced(path, data, perm, nil)
+}
+
+// WriteFileAtomicAdvanced is like |WriteFileAtomic| but permits to create the parent directory first
+// and to sync it after the rename (see |WriteFileOptions|).
+func WriteFileAtomicAdvanced(path string, data []byte, perm fs.FileMode, options *WriteFileOptions) error {
+	if options == nil {
+		options = &GDefaultWriteFileOptions
+	}
+
+	if options.CreateDir {
+		if err := EnsureParentDir(path, options.CreateDirFileMode); err != nil {
+			return err
+		}
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(extendedLengthPath(dir), base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file for %q: %w", path, err)
+	}
+	tmpPath := tmp.Name()
+
+	// Best effort cleanup. After a successful rename this is a no-op.
+	defer options.Retry.retry(func() error {
+		return os.Remove(tmpPath)
+	})
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %q: %w", tmpPath, err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("calling sync on %q: %w", tmpPath, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing %q: %w", tmpPath, err)
+	}
+
+	// |os.CreateTemp| always uses 0600.
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return fmt.Errorf("chmod %q: %w", tmpPath, err)
+	}
+
+	err = options.Retry.retry(func() error {
+		return osRename(tmpPath, extendedLengthPath(path))
+	})
+	if err != nil {
+		return fmt.Errorf("renaming %q -> %q: %w", tmpPath, path, err)
+	}
+
+	if options.SyncDir {
+		if err := syncParentDir(extendedLengthPath(path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteFilesAtomic writes all of |files| (path -> content), trying to make them appear together or
+// not at all. Every file is first written and synced to a temporary file next to its destination
+// and, only once all of them succeeded, they are renamed into place. If anything fails before the
+// rename phase, the temporary files are removed and no destination is touched.
+//
+// NOTE: This is not truly atomic across files: a failure during the rename phase leaves the files
+// renamed so far in place (the error reports which one failed). The window for that is small though.
+// New files are created with 0666 (before umask), like |os.Create| would.
+func WriteFilesAtomic(files map[string]string) error {
+	return WriteFilesAtomicAdvanced(files, nil)
+}
+
+// WriteFilesAtomicAdvanced is like |WriteFilesAtomic| but permits to create the parent directories
+// first, to retry the renames and cleanups on transient errors and to sync the parent directories
+// after the renames (see |WriteFileOptions|).
+func WriteFilesAtomicAdvanced(files map[string]string, options *WriteFileOptions) error {
+	if options == nil {
+		options = &GDefaultWriteFileOptions
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// |temps| maps each destination to its staged temporary file. Whatever remains in it by the end
+	// is removed.
+	temps := make(map[string]string, len(paths))
+	defer func() {
+		for _, tmpPath := range temps {
+			// Best effort. We don't want to shadow the original error.
+			options.Retry.retry(func() error {
+				return os.Remove(extendedLengthPath(tmpPath))
+			})
+		}
+	}()
+
+	// Stage phase.
+	for _, path := range paths {
+		if options.CreateDir {
+			if err := EnsureParentDir(path, options.CreateDirFileMode); err != nil {
+				return err
+			}
+		}
+
+		tmp, err := createTempSibling(path)
+		if err != nil {
+			return err
+		}
+		temps[path] = tmp.Name()
+
+		if _, err := tmp.WriteString(files[path]); err != nil {
+			tmp.Close()
+			return fmt.Errorf("writing %q: %w", tmp.Name(), err)
+		}
+
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("calling sync on %q: %w", tmp.Name(), err)
+		}
+
+		if err := tmp.Close(); err != nil {
+			return fmt.Errorf("closing %q: %w", tmp.Name(), err)
+		}
+	}
+
+	// Rename phase.
+	for _, path := range paths {
+		tmpPath := temps[path]
+		err := options.Retry.retry(func() error {
+			return osRename(extendedLengthPath(tmpPath), extendedLengthPath(path))
+		})
+		if err != nil {
+			return fmt.Errorf("renaming %q -> %q: %w", tmpPath, path, err)
+		}
+		delete(temps, path)
+	}
+
+	if options.SyncDir {
+		for _, path := range paths {
+			if err := syncParentDir(extendedLengthPath(path)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReplaceDirAtomic regenerates the directory at |finalPath|: |build| populates a new temporary
+// directory next to it, which then replaces |finalPath|. If |build| fails, |finalPath| is left
+// untouched. The new directory gets the permissions of the replaced one (0755 if there was none).
+//
+// NOTE: Directories cannot be atomically renamed over non-empty ones, so the old directory is first
+// moved aside, then the new one is moved in and finally the old one is removed. If moving the new
+// one in fails, the old one is moved back. There is a small window where |finalPath| does not
+// exist.
+func ReplaceDirAtomic(finalPath string, build func(tmpDir string) error) error {
+	return ReplaceDirAtomicAdvanced(finalPath, build, nil)
+}
+
+// ReplaceDirAtomicAdvanced is like |ReplaceDirAtomic| but permits to create the parent directory
+// first, to retry the renames and removals on transient errors and to sync the parent directory
+// after the replacement (see |WriteFileOptions|).
+func ReplaceDirAtomicAdvanced(finalPath string, build func(tmpDir string) error, options *WriteFileOptions) error {
+	if options == nil {
+		options = &GDefaultWriteFileOptions
+	}
+
+	finalPath = filepath.Clean(finalPath)
+	dir, base := filepath.Split(finalPath)
+	if dir == "" {
+		dir = "."
+	}
+
+	perm := fs.FileMode(0755)
+	stat, existed, err := StatFile(finalPath)
+	if err != nil {
+		return fmt.Errorf("statting %q: %w", finalPath, err)
+	}
+	if existed {
+		if !stat.IsDir() {
+			return fmt.Errorf("replacing %q: not a directory", finalPath)
+		}
+		perm = stat.Mode().Perm()
+	}
+
+	if options.CreateDir {
+		if err := EnsureParentDir(finalPath, options.CreateDirFileMode); err != nil {
+			return err
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp(extendedLengthPath(dir), base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temp dir for %q: %w", finalPath, err)
+	}
+
+	// Best effort cleanup. After a successful rename this is a no-op.
+	defer options.Retry.retry(func() error {
+		return os.RemoveAll(tmpDir)
+	})
+
+	// |os.MkdirTemp| always uses 0700.
+	if err := os.Chmod(tmpDir, perm); err != nil {
+		return fmt.Errorf("chmod %q: %w", tmpDir, err)
+	}
+
+	if err := build(tmpDir); err != nil {
+		return fmt.Errorf("building %q: %w", finalPath, err)
+	}
+
+	rename := func(from, to string) error {
+		return options.Retry.retry(func() error {
+			return osRename(extendedLengthPath(from), extendedLengthPath(to))
+		})
+	}
+
+	if !existed {
+		if err := rename(tmpDir, finalPath); err != nil {
+			return fmt.Errorf("renaming %q -> %q: %w", tmpDir, finalPath, err)
+		}
+		return syncReplacedDir(finalPath, options)
+	}
+
+	oldDir, err := unusedSiblingPath(finalPath, ".old")
+	if err != nil {
+		return err
+	}
+
+	if err := rename(finalPath, oldDir); err != nil {
+		return fmt.Errorf("moving aside %q -> %q: %w", finalPath, oldDir, err)
+	}
+
+	if err := rename(tmpDir, finalPath); err != nil {
+		renameErr := fmt.Errorf("renaming %q -> %q: %w", tmpDir, finalPath, err)
+		if err := rename(oldDir, finalPath); err != nil {
+			return errors.Join(renameErr, fmt.Errorf("restoring %q -> %q: %w", oldDir, finalPath, err))
+		}
+		return renameErr
+	}
+
+	err = options.Retry.retry(func() error {
+		return os.RemoveAll(extendedLengthPath(oldDir))
+	})
+	if err != nil {
+		return fmt.Errorf("removing old dir %q (%q was replaced): %w", oldDir, finalPath, err)
+	}
+
+	return syncReplacedDir(finalPath, options)
+}
+
+// syncReplacedDir syncs the parent of |finalPath| if requested by |options|.
+func syncReplacedDir(finalPath string, options *WriteFileOptions) error {
+	if !options.SyncDir {
+		return nil
+	}
+
+	return syncParentDir(extendedLengthPath(finalPath))
+}
+
+// unusedSiblingPath returns a path next to |path| (with |suffix| and a random component) that does
+// not exist at the moment.
+func unusedSiblingPath(path, suffix string) (string, error) {
+	for i := 0; i < 100; i++ {
+		candidate := fmt.Sprintf("%s%s-%d", path, suffix, rand.Uint32())
+		if _, err := os.Lstat(extendedLengthPath(candidate)); errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("finding unused path next to %q: too many collisions", path)
+}
+
+// createTempSibling creates a new file next to |path|, to be later renamed over it. Unlike
+// |os.CreateTemp|, the file is created with 0666 (before umask), the same as |os.Create| would.
+func createTempSibling(path string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		tmpPath := fmt.Sprintf("%s.tmp-%d", path, rand.Uint32())
+		file, err := os.OpenFile(extendedLengthPath(tmpPath), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return file, nil
+		}
+
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("creating temp file for %q: %w", path, err)
+		}
+	}
+
+	return nil, fmt.Errorf("creating temp file for %q: too many collisions", path)
+}
@@ -0,0 +1,103 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// failRenames makes the next |count| renames fail with a transient error.
+func failRenames(t *testing.T, count int) *int {
+	t.Helper()
+
+	transient := &os.LinkError{Op: "rename", Err: syscall.EBUSY}
+	if !IsTransientError(transient) {
+		t.Skip("EBUSY is not a transient error on this platform")
+	}
+
+	failures := 0
+	rename := osRename
+	osRename = func(from, to string) error {
+		if failures < count {
+			failures++
+			return transient
+		}
+		return rename(from, to)
+	}
+	t.Cleanup(func() { osRename = rename })
+
+	return &failures
+}
+
+var testRetryOptions = WriteFileOptions{
+	Retry: &RetryOptions{Attempts: 3},
+}
+
+func TestWriteFilesAtomicRetriesRenames(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		filepath.Join(dir, "a.txt"):        "a",
+		filepath.Join(dir, "sub", "b.txt"): "b",
+	}
+
+	options := testRetryOptions
+	options.CreateDir = true
+	options.CreateDirFileMode = 0755
+
+	failures := failRenames(t, 2)
+	if err := WriteFilesAtomicAdvanced(files, &options); err != nil {
+		t.Fatalf("WriteFilesAtomicAdvanced(): %v", err)
+	}
+
+	if *failures != 2 {
+		t.Errorf("%d renames failed, want 2", *failures)
+	}
+
+	for path, want := range files {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("ReadFile(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+}
+
+func TestReplaceDirAtomicRetriesRenames(t *testing.T) {
+	finalPath := filepath.Join(t.TempDir(), "out")
+	writeVersion := func(content string) func(string) error {
+		return func(tmpDir string) error {
+			return os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte(content), 0644)
+		}
+	}
+
+	// The first replacement creates the directory, the second one replaces it.
+	for _, content := range []string{"first", "second"} {
+		failRenames(t, 2)
+		if err := ReplaceDirAtomicAdvanced(finalPath, writeVersion(content), &testRetryOptions); err != nil {
+			t.Fatalf("ReplaceDirAtomicAdvanced(%q): %v", content, err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(finalPath, "file.txt"))
+		if err != nil || string(got) != content {
+			t.Errorf("ReadFile() = %q, %v, want %q", got, err, content)
+		}
+	}
+
+	// Only the final directory remains: no temporary nor old ones.
+	entries, err := os.ReadDir(filepath.Dir(finalPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("leftover entries next to %q: %v", finalPath, entries)
+	}
+}
+
+func TestReplaceDirAtomicWithoutRetryFails(t *testing.T) {
+	finalPath := filepath.Join(t.TempDir(), "out")
+
+	failRenames(t, 1)
+	err := ReplaceDirAtomic(finalPath, func(tmpDir string) error { return nil })
+	if !IsTransientError(err) {
+		t.Errorf("ReplaceDirAtomic() = %v, want the transient error", err)
+	}
+}
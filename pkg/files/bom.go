@@ -0,0 +1,67 @@
+package files
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Encoding identifies a text encoding, as signaled by a byte-order mark.
+type Encoding int
+
+const (
+	// EncodingUnknown means no byte-order mark was found.
+	EncodingUnknown Encoding = iota
+	EncodingUTF8
+	EncodingUTF16LE
+	EncodingUTF16BE
+)
+
+func (encoding Encoding) String() string {
+	switch encoding {
+	case EncodingUnknown:
+		return "Unknown"
+	case EncodingUTF8:
+		return "UTF-8"
+	case EncodingUTF16LE:
+		return "UTF-16LE"
+	case EncodingUTF16BE:
+		return "UTF-16BE"
+	}
+
+	return fmt.Sprintf("Encoding(%d)", int(encoding))
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// detectBOM returns the encoding signaled by the byte-order mark at the start of |data|, and the
+// length of said mark (0 if none).
+func detectBOM(data []byte) (Encoding, int) {
+	switch {
+	case bytes.HasPrefix(data, bomUTF8):
+		return EncodingUTF8, len(bomUTF8)
+	case bytes.HasPrefix(data, bomUTF16LE):
+		return EncodingUTF16LE, len(bomUTF16LE)
+	case bytes.HasPrefix(data, bomUTF16BE):
+		return EncodingUTF16BE, len(bomUTF16BE)
+	}
+
+	return EncodingUnknown, 0
+}
+
+// HasBOM returns whether |Data| starts with a UTF-8, UTF-16LE or UTF-16BE byte-order mark, and
+// which encoding it signals.
+func (lf *LoadedFile) HasBOM() (bool, Encoding) {
+	encoding, _ := detectBOM(lf.Data)
+	return encoding != EncodingUnknown, encoding
+}
+
+// DataWithoutBOM returns |Data| without its leading byte-order mark, if any. The returned slice
+// shares the underlying memory with |Data|.
+func (lf *LoadedFile) DataWithoutBOM() []byte {
+	_, n := detectBOM(lf.Data)
+	return lf.Data[n:]
+}
@@ -0,0 +1,182 @@
+package files
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// LoadDirFS loads all the files under |root| (see |FileCache.PreloadDir|) into a new cache and
+// returns an |fs.FS| over them (see |FileCache.FS|). This is an immutable snapshot of the directory
+// that never touches the disk again, useful for templating engines or serving static assets.
+func LoadDirFS(root string) (fs.FS, error) {
+	fc := NewFileCache()
+	if _, err := fc.PreloadDir(root); err != nil {
+		return nil, err
+	}
+
+	return fc.FS(root)
+}
+
+// FS returns a read-only |fs.FS| over the from-file entries of the cache located under |root|,
+// named by their path relative to it. The view is a snapshot of the cache at the moment of the call.
+// Only directories containing files exist in it. The files implement |io.Seeker| and |io.ReaderAt|,
+// so the view can be used with |http.FS|.
+func (fc *FileCache) FS(root string) (fs.FS, error) {
+	// The root must be in the same form as |LoadedFile.Path|, which could be fully resolved (see
+	// |SetCanonicalKeys|).
+	_, rootPath, err := fc.keyForPath(root)
+	if err != nil {
+		return nil, err
+	}
+
+	cfs := &cacheFS{
+		files: map[string]*LoadedFile{},
+		dirs:  map[string]map[string]fs.DirEntry{".": {}},
+	}
+
+	fc.Range(func(key string, lf *LoadedFile) bool {
+		if lf.Path() == "" {
+			return true
+		}
+
+		rel, err := RelUnix(rootPath, lf.Path())
+		if err != nil || rel == "." {
+			return true
+		}
+
+		cfs.files[rel] = lf
+
+		// Register the file and all its parents within their parent directories.
+		var entry fs.DirEntry = fs.FileInfoToDirEntry(newCacheFSFileInfo(rel, lf))
+		for name := rel; name != "."; name = path.Dir(name) {
+			parent := path.Dir(name)
+			if cfs.dirs[parent] == nil {
+				cfs.dirs[parent] = map[string]fs.DirEntry{}
+			}
+			cfs.dirs[parent][path.Base(name)] = entry
+			entry = fs.FileInfoToDirEntry(cacheFSDirInfo(path.Dir(name)))
+		}
+		return true
+	})
+
+	return cfs, nil
+}
+
+// cacheFS is the |fs.FS| returned by |FileCache.FS|.
+type cacheFS struct {
+	files map[string]*LoadedFile
+	// dirs maps each directory to its entries, keyed by name.
+	dirs map[string]map[string]fs.DirEntry
+}
+
+func (cfs *cacheFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if lf, ok := cfs.files[name]; ok {
+		return &cacheFSFile{
+			info:   newCacheFSFileInfo(name, lf),
+			Reader: bytes.NewReader(lf.Data),
+		}, nil
+	}
+
+	if entries, ok := cfs.dirs[name]; ok {
+		sorted := make([]fs.DirEntry, 0, len(entries))
+		for _, entry := range entries {
+			sorted = append(sorted, entry)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Name() < sorted[j].Name()
+		})
+
+		return &cacheFSDir{info: cacheFSDirInfo(name), entries: sorted}, nil
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// cacheFSFileInfo is the |fs.FileInfo| of the entries of a |cacheFS|.
+type cacheFSFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// newCacheFSFileInfo describes the file at |name| within the |cacheFS|. The size is the one of the
+// loaded data, which could differ from the one on disk (eg. because of loader hooks).
+func newCacheFSFileInfo(name string, lf *LoadedFile) *cacheFSFileInfo {
+	info := &cacheFSFileInfo{
+		name: path.Base(name),
+		size: int64(len(lf.Data)),
+		mode: 0444,
+	}
+
+	if lf.Stat != nil {
+		info.mode = lf.Stat.Mode().Perm()
+		info.modTime = lf.Stat.ModTime()
+	}
+
+	return info
+}
+
+func cacheFSDirInfo(name string) *cacheFSFileInfo {
+	return &cacheFSFileInfo{
+		name: path.Base(name),
+		mode: fs.ModeDir | 0555,
+	}
+}
+
+func (fi *cacheFSFileInfo) Name() string       { return fi.name }
+func (fi *cacheFSFileInfo) Size() int64        { return fi.size }
+func (fi *cacheFSFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *cacheFSFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *cacheFSFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *cacheFSFileInfo) Sys() any           { return nil }
+
+// cacheFSFile is an open file of a |cacheFS|.
+type cacheFSFile struct {
+	info *cacheFSFileInfo
+	*bytes.Reader
+}
+
+func (f *cacheFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *cacheFSFile) Close() error               { return nil }
+
+// cacheFSDir is an open directory of a |cacheFS|.
+type cacheFSDir struct {
+	info    *cacheFSFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *cacheFSDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *cacheFSDir) Close() error               { return nil }
+
+func (d *cacheFSDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir implements |fs.ReadDirFile|.
+func (d *cacheFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
@@ -0,0 +1,77 @@
+package files
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func makeFSTestDir(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		"a.txt":         "a",
+		"sub/b.txt":     "bb",
+		"sub/deep/c.md": "ccc",
+	} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, path, []byte(content))
+	}
+
+	return root
+}
+
+func TestLoadDirFS(t *testing.T) {
+	root := makeFSTestDir(t)
+
+	fsys, err := LoadDirFS(root)
+	if err != nil {
+		t.Fatalf("LoadDirFS(%q): %v", root, err)
+	}
+
+	// The view is a snapshot, so removing the directory must not affect it.
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(fsys, "a.txt", "sub/b.txt", "sub/deep/c.md"); err != nil {
+		t.Error(err)
+	}
+
+	if data, err := fs.ReadFile(fsys, "sub/deep/c.md"); err != nil || string(data) != "ccc" {
+		t.Errorf("ReadFile(sub/deep/c.md) = %q, %v, want %q", data, err, "ccc")
+	}
+}
+
+func TestFileCacheFSCanonicalKeys(t *testing.T) {
+	root := makeFSTestDir(t)
+
+	// Access the directory through a symlinked parent (as /var is on darwin), so that the canonical
+	// keys differ from the paths.
+	parentLink := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(filepath.Dir(root), parentLink); err != nil {
+		t.Skipf("creating symlink: %v", err)
+	}
+	link := filepath.Join(parentLink, filepath.Base(root))
+
+	fc := NewFileCache()
+	fc.SetCanonicalKeys(true)
+	if _, err := fc.PreloadDir(link); err != nil {
+		t.Fatalf("PreloadDir(%q): %v", link, err)
+	}
+
+	fsys, err := fc.FS(link)
+	if err != nil {
+		t.Fatalf("FS(%q): %v", link, err)
+	}
+
+	if err := fstest.TestFS(fsys, "a.txt", "sub/b.txt", "sub/deep/c.md"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,49 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// LoadFileCAS loads the file at |path| into the global cache keyed by its content.
+// See |FileCache.LoadCAS|.
+func LoadFileCAS(path string) (*LoadedFile, string, error) {
+	return GlobalFileCache().LoadCAS(path)
+}
+
+// QueryHash looks up a content-addressed entry in the global cache. See |FileCache.QueryHash|.
+func QueryHash(hash string) (bool, *LoadedFile) {
+	return GlobalFileCache().QueryHash(hash)
+}
+
+// LoadCAS reads the file at |path| and stores it in the cache keyed by the hex encoded sha256 of its
+// content, which is also returned. Files with identical content share a single entry, regardless of
+// their path. The hash matches |HashFile| unless a loader hook (see |RegisterLoaderHook|) changed
+// the content.
+// As the entry is not tied to a single path, it is an in-memory entry (ie. |FromFile| is false and
+// it has no |Stat|). Unlike the other loaders, the file is always read, as the key is not known
+// beforehand.
+func (fc *FileCache) LoadCAS(path string) (*LoadedFile, string, error) {
+	data, _, err := fc.readForLoad(context.Background(), &loadRequest{path: path})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	// If the content is already there, |NewFromData| returns the existing entry.
+	lf, err := fc.NewFromData(hash, data, false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return lf, hash, nil
+}
+
+// QueryHash returns the entry stored by |LoadCAS| for the content with the given (hex encoded
+// sha256) |hash|, if any.
+func (fc *FileCache) QueryHash(hash string) (bool, *LoadedFile) {
+	return fc.QueryKey(hash)
+}
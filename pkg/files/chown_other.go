@@ -0,0 +1,12 @@
+//go:build !unix
+
+package files
+
+import (
+	"errors"
+	"os"
+)
+
+func chownFile(file *os.File, ownership *Ownership) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,9 @@
+//go:build unix
+
+package files
+
+import "os"
+
+func chownFile(file *os.File, ownership *Ownership) error {
+	return file.Chown(ownership.UID, ownership.GID)
+}
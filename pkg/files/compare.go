@@ -0,0 +1,203 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CompareFiles returns whether the files at |a| and |b| have the same content. The sizes are
+// compared first, so different sized files are not read at all.
+func CompareFiles(a, b string) (bool, error) {
+	return CompareFilesAdvanced(a, b, nil)
+}
+
+type CompareOptions struct {
+	// IgnoreLineEndings treats CRLF and LF as equal. Useful for golden files checked out on both
+	// Windows and Unix. As the sizes no longer prove inequality, files are always read.
+	IgnoreLineEndings bool
+}
+
+var (
+	GDefaultCompareOptions = CompareOptions{
+		IgnoreLineEndings: false,
+	}
+)
+
+// CompareFilesAdvanced is like |CompareFiles|, but permits to ignore line ending differences.
+func CompareFilesAdvanced(a, b string, options *CompareOptions) (bool, error) {
+	if options == nil {
+		options = &GDefaultCompareOptions
+	}
+
+	statA, err := os.Stat(extendedLengthPath(a))
+	if err != nil {
+		return false, fmt.Errorf("statting %q: %w", a, err)
+	}
+
+	statB, err := os.Stat(extendedLengthPath(b))
+	if err != nil {
+		return false, fmt.Errorf("statting %q: %w", b, err)
+	}
+
+	if !options.IgnoreLineEndings && statA.Size() != statB.Size() {
+		return false, nil
+	}
+
+	fileA, err := os.Open(extendedLengthPath(a))
+	if err != nil {
+		return false, fmt.Errorf("opening %q: %w", a, err)
+	}
+	defer fileA.Close()
+
+	fileB, err := os.Open(extendedLengthPath(b))
+	if err != nil {
+		return false, fmt.Errorf("opening %q: %w", b, err)
+	}
+	defer fileB.Close()
+
+	if options.IgnoreLineEndings {
+		return readersEqual(&lfReader{r: bufio.NewReader(fileA)}, &lfReader{r: bufio.NewReader(fileB)})
+	}
+
+	return readersEqual(bufio.NewReader(fileA), bufio.NewReader(fileB))
+}
+
+// lfReader converts CRLF line endings into LF while reading. Lone CRs are kept.
+type lfReader struct {
+	r *bufio.Reader
+}
+
+func (lr *lfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := lr.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+
+		if b == '\r' {
+			next, err := lr.r.Peek(1)
+			if err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+
+		p[n] = b
+		n++
+	}
+
+	return n, nil
+}
+
+// readersEqual compares the content of both readers in chunks.
+func readersEqual(a, b io.Reader) (bool, error) {
+	const chunkSize = 64 * 1024
+	bufA := make([]byte, chunkSize)
+	bufB := make([]byte, chunkSize)
+
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, errB := io.ReadFull(b, bufB)
+
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("reading: %w", errA)
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("reading: %w", errB)
+		}
+
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+
+		// A short read means that we reached the end of the data.
+		if errA != nil || errB != nil {
+			return errA != nil && errB != nil, nil
+		}
+	}
+}
+
+// DirDiff holds the differences between two directory trees, as returned by |DiffDirs|.
+// All the paths are relative Unix paths, sorted lexically.
+type DirDiff struct {
+	OnlyInA   []string
+	OnlyInB   []string
+	Different []string
+}
+
+// Equal returns whether the trees had no differences.
+func (dd *DirDiff) Equal() bool {
+	return len(dd.OnlyInA) == 0 && len(dd.OnlyInB) == 0 && len(dd.Different) == 0
+}
+
+// DiffDirs compares the files of the directory trees |a| and |b|. The files present in both are
+// compared concurrently (see |CompareFiles|).
+func DiffDirs(a, b string) (*DirDiff, error) {
+	return DiffDirsAdvanced(a, b, nil)
+}
+
+// DiffDirsAdvanced is like |DiffDirs|, but the files are compared following |options| (see
+// |CompareFilesAdvanced|).
+func DiffDirsAdvanced(a, b string, options *CompareOptions) (*DirDiff, error) {
+	filesA, err := ListFilesRecursive(a)
+	if err != nil {
+		return nil, err
+	}
+
+	filesB, err := ListFilesRecursive(b)
+	if err != nil {
+		return nil, err
+	}
+
+	inB := make(map[string]bool, len(filesB))
+	for _, file := range filesB {
+		inB[file] = true
+	}
+
+	diff := &DirDiff{}
+	var common []string
+	for _, file := range filesA {
+		if inB[file] {
+			common = append(common, file)
+			delete(inB, file)
+		} else {
+			diff.OnlyInA = append(diff.OnlyInA, file)
+		}
+	}
+
+	// |filesB| is sorted, so we iterate it to keep that order.
+	for _, file := range filesB {
+		if inB[file] {
+			diff.OnlyInB = append(diff.OnlyInB, file)
+		}
+	}
+
+	type result struct {
+		equal bool
+		err   error
+	}
+	results := make([]result, len(common))
+
+	parallelFor(len(common), runtime.NumCPU(), func(index int) {
+		file := filepath.FromSlash(common[index])
+		equal, err := CompareFilesAdvanced(filepath.Join(a, file), filepath.Join(b, file), options)
+		results[index] = result{equal: equal, err: err}
+	})
+
+	for i, file := range common {
+		if results[i].err != nil {
+			return nil, fmt.Errorf("comparing %q: %w", file, results[i].err)
+		}
+
+		if !results[i].equal {
+			diff.Different = append(diff.Different, file)
+		}
+	}
+
+	return diff, nil
+}
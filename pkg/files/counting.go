@@ -0,0 +1,50 @@
+package files
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CountingReader wraps an |io.Reader| and counts the bytes read through it.
+// |Count| is safe to call concurrently with |Read| (eg. to report progress).
+type CountingReader struct {
+	r     io.Reader
+	count atomic.Int64
+}
+
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+func (cr *CountingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.count.Add(int64(n))
+	return n, err
+}
+
+// Count returns the amount of bytes read so far.
+func (cr *CountingReader) Count() int64 {
+	return cr.count.Load()
+}
+
+// CountingWriter wraps an |io.Writer| and counts the bytes written through it.
+// |Count| is safe to call concurrently with |Write| (eg. to report progress).
+type CountingWriter struct {
+	w     io.Writer
+	count atomic.Int64
+}
+
+func NewCountingWriter(w io.Writer) *CountingWriter {
+	return &CountingWriter{w: w}
+}
+
+func (cw *CountingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count.Add(int64(n))
+	return n, err
+}
+
+// Count returns the amount of bytes written so far.
+func (cw *CountingWriter) Count() int64 {
+	return cw.count.Load()
+}
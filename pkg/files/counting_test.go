@@ -0,0 +1,91 @@
+package files
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countConcurrently calls |count| in a loop until |done| is closed, checking that the count never
+// goes backwards nor over |max|.
+func countConcurrently(t *testing.T, wg *sync.WaitGroup, done <-chan struct{}, max int64, count func() int64) {
+	defer wg.Done()
+
+	var last int64
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		got := count()
+		if got < last || got > max {
+			t.Errorf("Count() = %d, previous %d, max %d", got, last, max)
+			return
+		}
+		last = got
+	}
+}
+
+func TestCountingWriterConcurrentCount(t *testing.T) {
+	const chunks = 1000
+	chunk := []byte("0123456789")
+	total := int64(chunks * len(chunk))
+
+	var buf bytes.Buffer
+	cw := NewCountingWriter(&buf)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go countConcurrently(t, &wg, done, total, cw.Count)
+	}
+
+	for i := 0; i < chunks; i++ {
+		if _, err := cw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if got := cw.Count(); got != total {
+		t.Errorf("Count() = %d, want %d", got, total)
+	}
+	if got := int64(buf.Len()); got != total {
+		t.Errorf("wrote %d bytes, want %d", got, total)
+	}
+}
+
+func TestCountingReaderConcurrentCount(t *testing.T) {
+	data := strings.Repeat("0123456789", 1000)
+	total := int64(len(data))
+
+	cr := NewCountingReader(strings.NewReader(data))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go countConcurrently(t, &wg, done, total, cr.Count)
+	}
+
+	// Small reads, so that the count moves while being read.
+	read, err := io.CopyBuffer(io.Discard, struct{ io.Reader }{cr}, make([]byte, 7))
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != total {
+		t.Errorf("read %d bytes, want %d", read, total)
+	}
+	if got := cr.Count(); got != total {
+		t.Errorf("Count() = %d, want %d", got, total)
+	}
+}
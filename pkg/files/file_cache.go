@@ -1,9 +1,21 @@
 package files
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/cristiandonosoc/golib/pkg/test_detection"
@@ -11,15 +23,126 @@ import (
 
 // Main API ----------------------------------------------------------------------------------------
 
+// ErrNotRegularFile is returned when attempting to load something that is not a regular file (eg. a
+// directory, a named pipe or a device).
+var ErrNotRegularFile = errors.New("not a regular file")
+
+// ErrFileTooLarge is returned when attempting to load a file bigger than the maximum size allowed by
+// the cache (see |FileCache.SetMaxFileSize|).
+var ErrFileTooLarge = errors.New("file too large")
+
 // LoadFileFromPath attempts to load a file from a path and will store it in the global cache.
 func LoadFileFromPath(path string) (*LoadedFile, error) {
-	key, err := filepath.Abs(path)
+	key, err := GlobalFileCache().KeyForPath(path)
 	if err != nil {
-		return nil, fmt.Errorf("abs %q: %w", path, err)
+		return nil, err
 	}
 	return GlobalFileCache().LoadFromPath(key, path, false)
 }
 
+// LoadFileFromPathContext is like |LoadFileFromPath|, but reading the file stops as soon as |ctx| is
+// cancelled. See |FileCache.LoadFromPathContext|.
+func LoadFileFromPathContext(ctx context.Context, path string) (*LoadedFile, error) {
+	key, err := GlobalFileCache().KeyForPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return GlobalFileCache().LoadFromPathContext(ctx, key, path, false)
+}
+
+// LoadFileFromPathCached is like |LoadFileFromPath|, but also returns whether the file was already
+// in the global cache (ie. whether it was a cache hit).
+func LoadFileFromPathCached(path string) (*LoadedFile, bool, error) {
+	key, err := GlobalFileCache().KeyForPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return GlobalFileCache().LoadFromPathCached(key, path, false)
+}
+
+// LoadFileUncached reads the file at |path| into a |LoadedFile| (with |Stat| and |FromFile| set)
+// without storing it in any cache, so it is not retained once the caller drops it. Loader hooks (see
+// |RegisterLoaderHook|) are still applied. The key is the one |LoadFileFromPath| would use (see
+// |FileCache.KeyForPath|).
+func LoadFileUncached(path string) (*LoadedFile, error) {
+	key, resolved, err := GlobalFileCache().keyForPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := osStat(path)
+	if err != nil {
+		return nil, fmt.Errorf("statting %q: %w", path, err)
+	}
+
+	if !s.Mode().IsRegular() {
+		return nil, fmt.Errorf("loading %q (%s): %w", path, s.Mode().Type(), ErrNotRegularFile)
+	}
+
+	data, err := readFile(context.Background(), path, false, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = applyLoaderHooks(path, false, data)
+	if err != nil {
+		return nil, err
+	}
+
+	lf := NewLoadedFile(key, data)
+	lf.FromFile = true
+	lf.path = resolved
+	lf.Stat = s
+	return lf, nil
+}
+
+// LoadGlob expands |pattern| (see |filepath.Glob|) and loads every matching file through the global
+// cache. Directories matching the pattern are skipped. The result is sorted by path.
+func LoadGlob(pattern string) ([]*LoadedFile, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	sort.Strings(matches)
+
+	lfs := make([]*LoadedFile, 0, len(matches))
+	for _, match := range matches {
+		stat, err := osStat(match)
+		if err != nil {
+			return nil, fmt.Errorf("statting %q: %w", match, err)
+		}
+
+		if stat.IsDir() {
+			continue
+		}
+
+		lf, err := LoadFileFromPath(match)
+		if err != nil {
+			return nil, fmt.Errorf("loading %q: %w", match, err)
+		}
+		lfs = append(lfs, lf)
+	}
+
+	return lfs, nil
+}
+
+// LoadFileFromPathDecompressed is like |LoadFileFromPath|, but if |path| ends in ".gz", the cached
+// data is the decompressed content. |Path| still reflects the original (compressed) path.
+// NOTE: Since the key is the same, loading the same path compressed and decompressed in the same
+// cache returns whichever was loaded first.
+func LoadFileFromPathDecompressed(path string) (*LoadedFile, error) {
+	key, err := GlobalFileCache().KeyForPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return GlobalFileCache().LoadFromPathDecompressed(key, path, false)
+}
+
+// PreloadDir loads all the files under |root| into the global cache. See |FileCache.PreloadDir|.
+func PreloadDir(root string) ([]*LoadedFile, error) {
+	return GlobalFileCache().PreloadDir(root)
+}
+
 // LoadFileFromPathWithKey is a more advanced way of loading files that permit to insert it in an
 // specific key, rather than using the abs path, as it is normally done.
 // |overwrite| refers to whether we allow people to overwrite keys or not.
@@ -28,115 +151,646 @@ func LoadFileFromPathWithKey(key, path string, overwrite bool) (*LoadedFile, err
 }
 
 // QueryKey checks to see if the key is in the global cache, and if so, returns the loaded file.
-// For files loaded as path, the key would the absolute path as returned by |filepath.Abs|.
+// For files loaded as path, the key would the absolute path as returned by |filepath.Abs| (see
+// |FileCache.KeyForPath|).
 func QueryKey(key string) (bool, *LoadedFile) {
 	return GlobalFileCache().QueryKey(key)
 }
 
 // NewFromData creates a in-memory loaded file from the given data and stores it in the cache with
 // the given key. From that moment on, it works similarly to a loaded file read from a file.
-// |overwrite| refers to whether we allow people to overwrite keys or not.
+// |overwrite| refers to whether we allow people to overwrite keys or not. See |FileCache.NewFromData|.
 func NewFromData(key string, data []byte, overwrite bool) (*LoadedFile, error) {
 	return GlobalFileCache().NewFromData(key, data, overwrite)
 }
 
 // Cache Implementation ----------------------------------------------------------------------------
 
-var once sync.Once
-var gFileCache *fileCache
+var gFileCacheMu sync.Mutex
+var gFileCache *FileCache
 
 // FileCache represents a view to files loaded in memory.
-type fileCache struct {
+// The limits of the global cache (see |SetLimits|) can be configured with the
+// GOLIB_FILECACHE_MAX_ENTRIES and GOLIB_FILECACHE_MAX_BYTES environment variables, and its
+// maximum file size (see |SetMaxFileSize|) with GOLIB_FILECACHE_MAX_FILE_SIZE.
+type FileCache struct {
 	files map[string]*LoadedFile
 	// useCache is whether we need to track cache or just bypass to loading files every time.
 	// Normally disabled for tests.
 	useCache bool
-	mu sync.Mutex
+	mu       sync.Mutex
+
+	// Eviction. See |SetLimits|.
+	maxEntries int
+	maxBytes   int64
+	totalBytes int64
+	// lru holds the keys in usage order, most recently used at the front.
+	lru      *list.List
+	lruElems map[string]*list.Element
+	pinned   map[string]bool
+
+	// maxFileSize is the biggest file that can be loaded from disk. 0 means no limit.
+	maxFileSize int64
+
+	// canonicalKeys is whether path keys are canonicalized. See |SetCanonicalKeys|.
+	canonicalKeys bool
 }
 
-func GlobalFileCache() *fileCache {
-	once.Do(func() {
-		gFileCache = &fileCache{
-			files:    map[string]*LoadedFile{},
-			useCache: true,
-		}
+// NewFileCache creates a new cache, independent from the global one. Unlike the global cache, the
+// caching is enabled even when running under tests.
+func NewFileCache() *FileCache {
+	return &FileCache{
+		files:    map[string]*LoadedFile{},
+		useCache: true,
+		lru:      list.New(),
+		lruElems: map[string]*list.Element{},
+		pinned:   map[string]bool{},
+	}
+}
+
+func GlobalFileCache() *FileCache {
+	gFileCacheMu.Lock()
+	defer gFileCacheMu.Unlock()
+
+	if gFileCache == nil {
+		gFileCache = NewFileCache()
 
 		if test_detection.RunningAsTest() {
 			gFileCache.useCache = false
 		}
-	})
+
+		gFileCache.maxEntries = int(envLimit("GOLIB_FILECACHE_MAX_ENTRIES"))
+		gFileCache.maxBytes = envLimit("GOLIB_FILECACHE_MAX_BYTES")
+		gFileCache.maxFileSize = envLimit("GOLIB_FILECACHE_MAX_FILE_SIZE")
+	}
 
 	return gFileCache
 }
 
+// envLimit reads a cache limit from the environment. An unset or invalid value means no limit.
+func envLimit(name string) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		log.Printf("WARNING: invalid %s=%q, falling back to unbounded", name, value)
+		return 0
+	}
+
+	return limit
+}
+
+// SetGlobalFileCache replaces the global cache with |fc|. This is meant for tests that want to
+// exercise the caching behaviour, which is normally disabled under tests. Use |NewFileCache| to
+// create an enabled cache and |ResetGlobalFileCache| to tear it down.
+func SetGlobalFileCache(fc *FileCache) {
+	gFileCacheMu.Lock()
+	defer gFileCacheMu.Unlock()
+
+	gFileCache = fc
+}
+
+// ResetGlobalFileCache drops the current global cache. The next call to |GlobalFileCache| will
+// create a fresh default one.
+func ResetGlobalFileCache() {
+	SetGlobalFileCache(nil)
+}
+
 // QueryKey checks the cache to see if that key has already been loaded.
-func (fc *fileCache) QueryKey(key string) (bool, *LoadedFile) {
+func (fc *FileCache) QueryKey(key string) (bool, *LoadedFile) {
 	if !fc.useCache {
 		return false, nil
 	}
 
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
 	if file, ok := fc.files[key]; ok {
+		fc.touchLocked(key)
 		return true, file
 	}
 
 	return false, nil
 }
 
+// Range calls |fn| for each entry in the cache, sorted by key, stopping if it returns false.
+// The entries are snapshotted before iterating, so |fn| can call back into the cache. This also
+// means that the iteration reflects the cache at the moment |Range| was called.
+func (fc *FileCache) Range(fn func(key string, lf *LoadedFile) bool) {
+	fc.mu.Lock()
+	keys := make([]string, 0, len(fc.files))
+	snapshot := make(map[string]*LoadedFile, len(fc.files))
+	for key, lf := range fc.files {
+		keys = append(keys, key)
+		snapshot[key] = lf
+	}
+	fc.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, snapshot[key]) {
+			return
+		}
+	}
+}
+
+// StaleKeys returns the (sorted) keys of the from-file entries whose file changed on disk since
+// they were loaded (see |LoadedFile.IsStale|). Files are only statted, not read, so this is a cheap
+// way of knowing what needs to be reloaded.
+func (fc *FileCache) StaleKeys() ([]string, error) {
+	var stale []string
+	var err error
+	fc.Range(func(key string, lf *LoadedFile) bool {
+		var isStale bool
+		isStale, err = lf.IsStale()
+		if err != nil {
+			err = fmt.Errorf("checking %q: %w", key, err)
+			return false
+		}
+
+		if isStale {
+			stale = append(stale, key)
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stale, nil
+}
+
+// SetMaxFileSize makes loading files from disk bigger than |size| bytes fail with |ErrFileTooLarge|,
+// rather than reading them into memory. For decompressed loads, the limit applies to both the
+// compressed and decompressed sizes. 0 means no limit.
+func (fc *FileCache) SetMaxFileSize(size int64) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.maxFileSize = size
+}
+
+// SetCanonicalKeys makes the keys of files loaded by path (see |KeyForPath|) canonical: symlinks
+// are resolved and, on platforms with case-insensitive filesystems by default (Windows and macOS),
+// the path is lowercased. This way the same file always maps to a single entry. Disabled by default,
+// in which case the key is just the absolute path.
+// Entries already in the cache keep their keys.
+func (fc *FileCache) SetCanonicalKeys(enabled bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.canonicalKeys = enabled
+}
+
+// KeyForPath returns the key under which |path| is stored when loaded by path, such as with
+// |LoadFileFromPath|. See |SetCanonicalKeys|.
+func (fc *FileCache) KeyForPath(path string) (string, error) {
+	key, _, err := fc.keyForPath(path)
+	return key, err
+}
+
+// keyForPath is like |KeyForPath|, but also returns the path the key is derived from: the absolute
+// path or, with canonical keys, the fully resolved one. Unlike the key, it is never case-folded, so
+// it is what the entries report as their |LoadedFile.Path|.
+func (fc *FileCache) keyForPath(path string) (key, resolved string, err error) {
+	fc.mu.Lock()
+	canonical := fc.canonicalKeys
+	fc.mu.Unlock()
+
+	if !canonical {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", "", fmt.Errorf("abs %q: %w", path, err)
+		}
+		return abs, abs, nil
+	}
+
+	resolved, err = ResolvePath(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", "", err
+		}
+
+		// Loading will fail anyway, but we want to report that error rather than this one.
+		if resolved, err = filepath.Abs(path); err != nil {
+			return "", "", fmt.Errorf("abs %q: %w", path, err)
+		}
+	}
+
+	key = resolved
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		key = strings.ToLower(key)
+	}
+
+	return key, resolved, nil
+}
+
+// Remove evicts |key| from the cache. It is a no-op if the key is not present.
+func (fc *FileCache) Remove(key string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.removeLocked(key)
+}
+
 // LoadFromPath creates a new loaded file from a path.
 // The key of the file will be the absolute path of the file.
-func (fc *fileCache) LoadFromPath(key, path string, overwrite bool) (*LoadedFile, error) {
-	// Check if the file is already read.
-	if fc.useCache {
-		if !overwrite {
-			if lf, ok := fc.files[key]; ok {
-				return lf, nil
+func (fc *FileCache) LoadFromPath(key, path string, overwrite bool) (*LoadedFile, error) {
+	lf, _, err := fc.LoadFromPathCached(key, path, overwrite)
+	return lf, err
+}
+
+// LoadFromPathCached is like |LoadFromPath|, but also returns whether the file was already in the
+// cache (ie. whether it was a cache hit).
+func (fc *FileCache) LoadFromPathCached(key, path string, overwrite bool) (*LoadedFile, bool, error) {
+	return fc.load(&loadRequest{
+		key:       key,
+		path:      path,
+		overwrite: overwrite,
+	})
+}
+
+// LoadFromPathContext is like |LoadFromPath|, but reading the file stops as soon as |ctx| is
+// cancelled (see |ReadFileContext|). A cache hit always succeeds.
+func (fc *FileCache) LoadFromPathContext(ctx context.Context, key, path string, overwrite bool) (*LoadedFile, error) {
+	lf, _, err := fc.load(&loadRequest{
+		ctx:       ctx,
+		key:       key,
+		path:      path,
+		overwrite: overwrite,
+	})
+	return lf, err
+}
+
+// LoadFromPathDecompressed is like |LoadFromPath|, but if |path| ends in ".gz", the stored data is
+// the decompressed content. |Stat| still refers to the compressed file.
+func (fc *FileCache) LoadFromPathDecompressed(key, path string, overwrite bool) (*LoadedFile, error) {
+	lf, _, err := fc.load(&loadRequest{
+		key:       key,
+		path:      path,
+		overwrite: overwrite,
+		gunzip:    true,
+	})
+	return lf, err
+}
+
+// PreloadDir loads all the regular files under |root| into the cache, keyed by their path (as
+// |LoadFileFromPath| would, see |KeyForPath|). The result is sorted by path.
+// Anything else is skipped: directories, special files (eg. FIFOs or sockets), and symlinks whose
+// target is not a regular file (eg. links to directories, or broken links). Symlinks are not walked
+// into.
+// The file info is taken from the directory listing (see |fs.DirEntry.Info|) rather than statting
+// each file. On Windows the listing already carries it, which saves a syscall per file. On Unix
+// |fs.DirEntry.Info| does an lstat anyway, so there is no saving there.
+func (fc *FileCache) PreloadDir(root string) ([]*LoadedFile, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("abs %q: %w", root, err)
+	}
+
+	var lfs []*LoadedFile
+	err = walkRelative(absRoot, func(rel string, d fs.DirEntry) error {
+		path := filepath.Join(absRoot, filepath.FromSlash(rel))
+
+		var stat fs.FileInfo
+		switch {
+		case d.Type().IsRegular():
+			// If this fails, the loader will stat the file itself.
+			if info, err := d.Info(); err == nil {
+				stat = info
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			// The entry info refers to the link, so we need to stat the target.
+			target, err := osStat(path)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return fmt.Errorf("statting %q: %w", path, err)
 			}
+
+			if !target.Mode().IsRegular() {
+				return nil
+			}
+			stat = target
+		default:
+			return nil
+		}
+
+		key, err := fc.KeyForPath(path)
+		if err != nil {
+			return err
+		}
+
+		lf, _, err := fc.load(&loadRequest{
+			key:  key,
+			path: path,
+			stat: stat,
+		})
+		if err != nil {
+			return fmt.Errorf("loading %q: %w", path, err)
+		}
+
+		lfs = append(lfs, lf)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lfs, nil
+}
+
+// loadRequest describes how to load a file from disk into the cache.
+type loadRequest struct {
+	// ctx, if set, permits to cancel the read.
+	ctx       context.Context
+	key       string
+	path      string
+	overwrite bool
+
+	// stat, if set, is used rather than statting the file again.
+	stat fs.FileInfo
+	// gunzip transparently decompresses files ending in ".gz".
+	gunzip bool
+}
+
+// load implements the loading of files from disk into the cache. |hit| reports whether the entry
+// was already in the cache (and thus the file was not read).
+func (fc *FileCache) load(req *loadRequest) (lf *LoadedFile, hit bool, err error) {
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if !req.overwrite {
+		if found, lf := fc.QueryKey(req.key); found {
+			return lf, true, nil
 		}
 	}
 
-	stat, err := os.Stat(path)
+	data, s, err := fc.readForLoad(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("statting %q: %w", path, err)
+		return nil, false, err
+	}
+
+	// The key could be an arbitrary string (or case-folded), so we keep the path of the file too.
+	_, resolved, err := fc.keyForPath(req.path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The entry is fully built before it is shared through the cache, as other goroutines could be
+	// reading it as soon as it is inserted.
+	loaded := NewLoadedFile(req.key, data)
+	loaded.FromFile = true
+	loaded.path = resolved
+	loaded.Stat = s
+	loaded.decompressed = req.gunzip
+
+	lf, err = fc.insertFile(loaded, req.overwrite)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Another goroutine could have loaded the same file in the meantime, in which case its entry is
+	// returned. It still counts as a miss, as we did read the file.
+	return lf, false, nil
+}
+
+// readForLoad reads the file of |req| from disk, enforcing the restrictions of the cache (see
+// |ErrNotRegularFile| and |SetMaxFileSize|) and applying the loader hooks.
+func (fc *FileCache) readForLoad(ctx context.Context, req *loadRequest) ([]byte, fs.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
 	}
 
-	data, err := os.ReadFile(path)
+	s := req.stat
+	if s == nil {
+		var err error
+		s, err = osStat(req.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("statting %q: %w", req.path, err)
+		}
+	}
+
+	// Reading a FIFO or a device could hang, so we bail out before attempting to.
+	if !s.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("loading %q (%s): %w", req.path, s.Mode().Type(), ErrNotRegularFile)
+	}
+
+	fc.mu.Lock()
+	maxFileSize := fc.maxFileSize
+	fc.mu.Unlock()
+
+	if maxFileSize > 0 && s.Size() > maxFileSize {
+		return nil, nil, fmt.Errorf("loading %q (%d bytes, max %d): %w", req.path, s.Size(), maxFileSize, ErrFileTooLarge)
+	}
+
+	data, err := readFile(ctx, req.path, req.gunzip, maxFileSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = applyLoaderHooks(req.path, req.gunzip, data)
 	if err != nil {
-		return nil, fmt.Errorf("reading %q: %w", path, err)
+		return nil, nil, err
 	}
 
-	lf, err := fc.NewFromData(key, data, overwrite)
+	return data, s, nil
+}
+
+// osStat and osReadFile are seams over the filesystem access of the loaders, so that tests can
+// inject a fake filesystem.
+var osStat = os.Stat
+var osReadFile = ReadFileContext
+
+// readFile reads the file, decompressing it if |gunzip| is set. |maxSize|, if positive, bounds the
+// decompressed size.
+func readFile(ctx context.Context, path string, gunzip bool, maxSize int64) ([]byte, error) {
+	data, err := osReadFile(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	lf.Stat = stat
-	return lf, nil
+	if !gunzip || !strings.HasSuffix(path, ".gz") {
+		return data, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("opening gzip reader for %q: %w", path, err)
+	}
+	defer gz.Close()
+
+	var reader io.Reader = &contextReader{ctx: ctx, r: gz}
+	if maxSize > 0 {
+		// We read one extra byte to detect going over the limit without decompressing everything.
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %q: %w", path, err)
+	}
+
+	if maxSize > 0 && int64(len(decompressed)) > maxSize {
+		return nil, fmt.Errorf("decompressing %q (max %d bytes): %w", path, maxSize, ErrFileTooLarge)
+	}
+
+	return decompressed, nil
+}
+
+// LoadWith returns the entry for |key| if it is already in the cache. Otherwise it calls |loader|
+// to obtain the data and stores it under |key|. This permits to reuse the cache for data that
+// doesn't come from disk (eg. a remote store).
+// |overwrite| refers to whether we allow people to overwrite keys or not. If true, |loader| is
+// always called.
+func (fc *FileCache) LoadWith(key string, loader func() ([]byte, error), overwrite bool) (*LoadedFile, error) {
+	// Check if the key is already loaded.
+	if !overwrite {
+		if found, lf := fc.QueryKey(key); found {
+			return lf, nil
+		}
+	}
+
+	data, err := loader()
+	if err != nil {
+		return nil, err
+	}
+
+	return fc.NewFromData(key, data, overwrite)
 }
 
 // NewFromData creates a new loadedFile with the provided key and content.
-// The key must not be in use already.
+// Unless |overwrite| is set, the key must not be in use already, though if the existing entry has
+// the very same data it is returned rather than failing. This makes concurrent population of the
+// same key (eg. two goroutines loading the same file) safe.
 // This is normally used for in-memory files, usually for testing purposes.
-func (fc *fileCache) NewFromData(key string, data []byte, overwrite bool) (*LoadedFile, error) {
+func (fc *FileCache) NewFromData(key string, data []byte, overwrite bool) (*LoadedFile, error) {
+	return fc.insertFile(NewLoadedFile(key, data), overwrite)
+}
+
+// insertFile stores |lf| in the cache, following the same rules as |NewFromData|. If an entry with
+// the same data already exists, that one is returned and |lf| is discarded. |lf| must not be
+// modified after this call, as it is now shared.
+func (fc *FileCache) insertFile(lf *LoadedFile, overwrite bool) (*LoadedFile, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if !fc.useCache {
+		return lf, nil
+	}
+
 	// We should not have the key already.
-	if fc.useCache {
-		if !overwrite {
-			if _, ok := fc.files[key]; ok {
-				return nil, fmt.Errorf("key %q is already in use", key)
+	if !overwrite {
+		if existing, ok := fc.files[lf.Key]; ok {
+			if !bytes.Equal(existing.Data, lf.Data) {
+				return nil, fmt.Errorf("key %q is already in use with different data", lf.Key)
 			}
+
+			fc.touchLocked(lf.Key)
+			return existing, nil
 		}
 	}
 
-	file := &LoadedFile{
-		Key:  key,
-		Data: data,
-	}
+	fc.insertLocked(lf.Key, lf)
+	return lf, nil
+}
+
+// Eviction ----------------------------------------------------------------------------------------
+
+// SetLimits bounds the cache to |maxEntries| entries and |maxBytes| bytes of data. 0 means no limit.
+// When inserting goes over the limits, the least recently used entries are evicted.
+// Pinned entries (see |Pin|) are never evicted: if only pinned entries remain, the cache is allowed
+// to grow beyond the limits. An unpinned entry that is bigger than |maxBytes| on its own is still
+// returned to the caller, but it is not kept in the cache.
+func (fc *FileCache) SetLimits(maxEntries int, maxBytes int64) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.maxEntries = maxEntries
+	fc.maxBytes = maxBytes
+	fc.evictLocked()
+}
+
+// Pin excludes |key| from eviction. The key doesn't need to be in the cache yet, so it's possible
+// to pin entries before loading them.
+func (fc *FileCache) Pin(key string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.pinned[key] = true
+}
 
+// Unpin makes |key| a candidate for eviction again.
+func (fc *FileCache) Unpin(key string) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
 
-	if fc.useCache {
-		fc.files[key] = file
+	delete(fc.pinned, key)
+	fc.evictLocked()
+}
+
+// insertLocked adds (or replaces) an entry, evicting others if needed. Must hold |mu|.
+func (fc *FileCache) insertLocked(key string, lf *LoadedFile) {
+	fc.removeLocked(key)
+
+	fc.files[key] = lf
+	lf.owner.Store(fc)
+	fc.totalBytes += int64(len(lf.Data))
+	fc.lruElems[key] = fc.lru.PushFront(key)
+
+	fc.evictLocked()
+}
+
+// removeLocked removes an entry if present. Must hold |mu|.
+func (fc *FileCache) removeLocked(key string) {
+	lf, ok := fc.files[key]
+	if !ok {
+		return
+	}
+
+	fc.totalBytes -= int64(len(lf.Data))
+	delete(fc.files, key)
+	lf.owner.Store(nil)
+	if elem, ok := fc.lruElems[key]; ok {
+		fc.lru.Remove(elem)
+		delete(fc.lruElems, key)
+	}
+}
+
+// touchLocked marks the entry as the most recently used. Must hold |mu|.
+func (fc *FileCache) touchLocked(key string) {
+	if elem, ok := fc.lruElems[key]; ok {
+		fc.lru.MoveToFront(elem)
+	}
+}
+
+// evictLocked removes the least recently used unpinned entries until the cache is within limits.
+// Must hold |mu|.
+func (fc *FileCache) evictLocked() {
+	overLimits := func() bool {
+		if fc.maxEntries > 0 && len(fc.files) > fc.maxEntries {
+			return true
+		}
+
+		return fc.maxBytes > 0 && fc.totalBytes > fc.maxBytes
 	}
 
-	return file, nil
+	elem := fc.lru.Back()
+	for elem != nil && overLimits() {
+		prev := elem.Prev()
+
+		key := elem.Value.(string)
+		if !fc.pinned[key] {
+			fc.removeLocked(key)
+		}
+
+		elem = prev
+	}
 }
@@ -0,0 +1,264 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadFromPathConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("hello\nworld\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fc := NewFileCache()
+
+	const goroutines = 64
+	lfs := make([]*LoadedFile, goroutines)
+	errs := make([]error, goroutines)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			lf, err := fc.LoadFromPath(path, path, false)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			// Read the entry right away, as a user of the cache would.
+			_ = lf.Path()
+			lfs[i] = lf
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i := 0; i < goroutines; i++ {
+		if errs[i] != nil {
+			t.Fatalf("LoadFromPath(%q): %v", path, errs[i])
+		}
+
+		if !lfs[i].FromFile || lfs[i].Stat == nil {
+			t.Errorf("LoadFromPath(%q) = {FromFile: %t, Stat: %v}, want a from-file entry", path, lfs[i].FromFile, lfs[i].Stat)
+		}
+	}
+
+	found, cached := fc.QueryKey(path)
+	if !found {
+		t.Fatalf("QueryKey(%q) not found", path)
+	}
+
+	if string(cached.Data) != "hello\nworld\n" {
+		t.Errorf("QueryKey(%q).Data = %q", path, cached.Data)
+	}
+}
+
+func TestReadFileDecompressCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt.gz")
+	writeTestFile(t, path, gzipped(t, "content"))
+
+	// Ignore the context while reading the compressed data, so that only decompression can notice
+	// the cancellation.
+	readFileSeam := osReadFile
+	osReadFile = func(_ context.Context, path string) ([]byte, error) { return os.ReadFile(path) }
+	t.Cleanup(func() { osReadFile = readFileSeam })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, maxSize := range []int64{0, 10 << 20} {
+		if _, err := readFile(ctx, path, true, maxSize); !errors.Is(err, context.Canceled) {
+			t.Errorf("readFile(cancelled, %q, maxSize: %d) = %v, want %v", path, maxSize, err, context.Canceled)
+		}
+	}
+}
+
+// makeBenchmarkDir creates a directory with |count| small files spread over a few subdirectories.
+func makeBenchmarkDir(b *testing.B, count int) string {
+	b.Helper()
+
+	root := b.TempDir()
+	for i := 0; i < count; i++ {
+		path := filepath.Join(root, fmt.Sprintf("dir-%02d", i%16), fmt.Sprintf("file-%05d.txt", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func BenchmarkPreloadDir(b *testing.B) {
+	root := makeBenchmarkDir(b, 10000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := NewFileCache().PreloadDir(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPreloadDirStatEachFile is the baseline for |BenchmarkPreloadDir|: the same files loaded
+// one by one, statting each of them.
+func BenchmarkPreloadDirStatEachFile(b *testing.B) {
+	root := makeBenchmarkDir(b, 10000)
+	paths, err := ListFilesRecursive(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		fc := NewFileCache()
+		for _, path := range paths {
+			path = filepath.Join(root, filepath.FromSlash(path))
+			if _, err := fc.LoadFromPath(path, path, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestLoadDirectoryIsNotRegularFile(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := NewFileCache().LoadFromPath(dir, dir, false); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("LoadFromPath(%q) = %v, want %v", dir, err, ErrNotRegularFile)
+	}
+
+	if _, err := LoadFileUncached(dir); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("LoadFileUncached(%q) = %v, want %v", dir, err, ErrNotRegularFile)
+	}
+}
+
+func TestUncachedLoadersUseCanonicalKeys(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.txt")
+	writeTestFile(t, target, []byte("content\n"))
+
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("creating symlink: %v", err)
+	}
+
+	GlobalFileCache().SetCanonicalKeys(true)
+	t.Cleanup(func() { GlobalFileCache().SetCanonicalKeys(false) })
+
+	want, err := GlobalFileCache().KeyForPath(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uncached, err := LoadFileUncached(link)
+	if err != nil {
+		t.Fatalf("LoadFileUncached(%q): %v", link, err)
+	}
+	if uncached.Key != want {
+		t.Errorf("LoadFileUncached(%q).Key = %q, want %q", link, uncached.Key, want)
+	}
+
+	lazy, err := LoadFileLazy(link)
+	if err != nil {
+		t.Fatalf("LoadFileLazy(%q): %v", link, err)
+	}
+	if lazy.Key != want {
+		t.Errorf("LoadFileLazy(%q).Key = %q, want %q", link, lazy.Key, want)
+	}
+}
+
+func TestPreloadDirSkipsNonRegularFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "dir", "file.txt"), []byte("content"))
+
+	links := map[string]string{
+		"dir-link":    "dir",
+		"file-link":   filepath.Join("dir", "file.txt"),
+		"broken-link": "missing",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("creating symlink: %v", err)
+		}
+	}
+
+	lfs, err := NewFileCache().PreloadDir(root)
+	if err != nil {
+		t.Fatalf("PreloadDir(%q): %v", root, err)
+	}
+
+	var got []string
+	for _, lf := range lfs {
+		rel, err := RelUnix(root, lf.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rel)
+	}
+
+	want := []string{"dir/file.txt", "file-link"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PreloadDir(%q) loaded %q, want %q", root, got, want)
+	}
+
+	// |LoadDirFS| goes through |PreloadDir|, so it must not fail either.
+	fsys, err := LoadDirFS(root)
+	if err != nil {
+		t.Fatalf("LoadDirFS(%q): %v", root, err)
+	}
+	if err := fstest.TestFS(fsys, want...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetDataUpdatesCacheSize(t *testing.T) {
+	fc := NewFileCache()
+
+	a, err := fc.NewFromData("a", []byte("aaaa"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fc.NewFromData("b", []byte("bbbb"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	a.SetData([]byte("aaaaaaaa"))
+	if fc.totalBytes != 12 {
+		t.Errorf("totalBytes after growing = %d, want 12", fc.totalBytes)
+	}
+
+	// Going over the limits evicts the least recently used entry, which is the one that grew.
+	fc.SetLimits(0, 10)
+	if found, _ := fc.QueryKey("a"); found {
+		t.Errorf("QueryKey(a) found, want it evicted")
+	}
+	if fc.totalBytes != 4 {
+		t.Errorf("totalBytes after eviction = %d, want 4", fc.totalBytes)
+	}
+
+	// Once out of the cache, the entry no longer affects it.
+	a.SetData(nil)
+	fc.Remove("b")
+	if fc.totalBytes != 0 {
+		t.Errorf("totalBytes after removing everything = %d, want 0", fc.totalBytes)
+	}
+}
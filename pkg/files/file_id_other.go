@@ -0,0 +1,25 @@
+//go:build !unix
+
+package files
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// fileID returns a comparable value that uniquely identifies the file at |path|.
+// Without inodes, we use the fully resolved absolute path.
+func fileID(path string, info fs.FileInfo) (any, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", path, err)
+	}
+
+	abs, err := filepath.Abs(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("abs %q: %w", resolved, err)
+	}
+
+	return abs, nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package files
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+type unixFileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileID returns a comparable value that uniquely identifies the file described by |info|.
+// On Unix we use the device and inode numbers.
+func fileID(path string, info fs.FileInfo) (any, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("no stat_t for %q", path)
+	}
+
+	return unixFileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, nil
+}
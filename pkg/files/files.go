@@ -2,13 +2,19 @@
 package files
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+
+	"github.com/cristiandonosoc/golib/pkg/test_detection"
 )
 
 // ToUnixPath standardizes the path to be Unix-like. This is useful for making paths work
@@ -17,9 +23,205 @@ func ToUnixPath(path string) string {
 	return strings.ReplaceAll(path, "\\", "/")
 }
 
+// ToNativePath is the inverse of |ToUnixPath|: it converts the forward slashes in |path| to the
+// separator of the current OS (see |filepath.FromSlash|). This is what external tools expecting
+// backslashes on Windows need. Within the same platform, |ToNativePath(ToUnixPath(p))| returns |p|
+// (on Unix, as long as no file name within |p| contains a literal backslash).
+func ToNativePath(path string) string {
+	return filepath.FromSlash(path)
+}
+
+// IsAbsAny returns whether |path| is absolute either in Unix ("/...") or Windows form, regardless of
+// the current OS. Windows absolute paths are drive-absolute ("C:\..." or "C:/...") or UNC
+// ("\\server\share\...", which includes the "\\?\" extended-length form). Useful for paths that come
+// from another OS, such as manifests generated on Windows. Note that the drive-relative "C:foo" and
+// the rooted "\foo" are not absolute on Windows either.
+func IsAbsAny(path string) bool {
+	if strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\\`) {
+		return true
+	}
+
+	if len(path) >= 3 && path[1] == ':' && (path[2] == '\\' || path[2] == '/') {
+		letter := path[0]
+		return ('a' <= letter && letter <= 'z') || ('A' <= letter && letter <= 'Z')
+	}
+
+	return false
+}
+
+// CommonPathPrefix returns the longest path prefix shared by all |paths|, compared component by
+// component (so "/a/bc" and "/a/bd" yield "/a"). The paths are cleaned and converted with
+// |ToUnixPath| first, and so is the result. Returns empty if there is no common prefix.
+func CommonPathPrefix(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	common := strings.Split(ToUnixPath(filepath.Clean(paths[0])), "/")
+	for _, path := range paths[1:] {
+		components := strings.Split(ToUnixPath(filepath.Clean(path)), "/")
+
+		n := 0
+		for n < len(common) && n < len(components) && common[n] == components[n] {
+			n++
+		}
+		common = common[:n]
+	}
+
+	if len(common) == 0 {
+		return ""
+	}
+
+	// Only the root is shared ("/" or a volume such as "C:/"), which would be lost by joining.
+	if len(common) == 1 && (common[0] == "" || strings.HasSuffix(common[0], ":")) {
+		return common[0] + "/"
+	}
+
+	return strings.Join(common, "/")
+}
+
+// ErrNotSubPath is returned by |RelUnix| when the target is not located within the base.
+var ErrNotSubPath = errors.New("path is not within base")
+
+// RelUnix returns the Unix-style (see |ToUnixPath|) relative path of |target| from |base|. Like
+// |filepath.Rel|, both paths must be either absolute or relative. The returned path is clean and
+// "." if both paths are the same. If |target| is not within |base|, the error wraps
+// |ErrNotSubPath|.
+func RelUnix(base, target string) (string, error) {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return "", fmt.Errorf("relative path of %q from %q: %w", target, base, err)
+	}
+
+	rel = ToUnixPath(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("relative path of %q from %q: %w", target, base, ErrNotSubPath)
+	}
+
+	return rel, nil
+}
+
+// AbsFrom returns |path| made absolute against |base| (rather than the working directory, as
+// |filepath.Abs| does) if it is relative, or as is if it already is absolute. The result is clean.
+// |base| itself is made absolute first if needed.
+func AbsFrom(base, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", fmt.Errorf("abs %q: %w", base, err)
+	}
+
+	return filepath.Join(absBase, path), nil
+}
+
+// WorkspaceRoot returns the directory that relative paths given by the user should be relative to.
+// When running via `bazel run` (see |test_detection.RunningAsBazelRun|) this is the workspace
+// (BUILD_WORKSPACE_DIRECTORY), as the working directory is within the runfiles tree. Otherwise it
+// is the working directory.
+func WorkspaceRoot() (string, error) {
+	if test_detection.RunningAsBazelRun() {
+		return os.Getenv("BUILD_WORKSPACE_DIRECTORY"), nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("getting working directory: %w", err)
+	}
+
+	return wd, nil
+}
+
+// AbsFromWorkspace is like |AbsFrom|, using |WorkspaceRoot| as base.
+func AbsFromWorkspace(path string) (string, error) {
+	root, err := WorkspaceRoot()
+	if err != nil {
+		return "", err
+	}
+
+	return AbsFrom(root, path)
+}
+
+// IsSubPath returns whether |child| is |parent| itself or is located somewhere within it. Both paths
+// are made absolute and cleaned before comparing, but symlinks are not resolved.
+func IsSubPath(parent, child string) (bool, error) {
+	absParent, err := filepath.Abs(parent)
+	if err != nil {
+		return false, fmt.Errorf("abs %q: %w", parent, err)
+	}
+
+	absChild, err := filepath.Abs(child)
+	if err != nil {
+		return false, fmt.Errorf("abs %q: %w", child, err)
+	}
+
+	// Any error means the paths are unrelated (eg. different volumes on Windows).
+	if _, err := RelUnix(absParent, absChild); err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// EnsureParentDir creates the directory that would contain |path| (and all its parents) if it does
+// not exist already. If |mode| is 0, 0755 is used.
+func EnsureParentDir(path string, mode fs.FileMode) error {
+	if mode == 0 {
+		mode = 0755
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(extendedLengthPath(dir), mode); err != nil {
+		return fmt.Errorf("mkdirall %q: %w", dir, err)
+	}
+
+	return nil
+}
+
 // RewriteFile will create/truncate the file and write the content.
 func RewriteFile(path, content string) error {
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	return RewriteFileAdvanced(path, content, nil)
+}
+
+type WriteFileOptions struct {
+	// CreateDir determines whether to try to create the owning directory of the written file.
+	CreateDir         bool
+	CreateDirFileMode fs.FileMode
+
+	// SyncDir calls sync on the parent directory after the file is written (and renamed into place,
+	// for atomic writes). Some filesystems need this to durably persist the new directory entry
+	// across a power loss. No-op on Windows.
+	SyncDir bool
+
+	// Retry, if set, retries the renames of atomic writes, and the removal of their temporary files,
+	// on transient errors (see |WithRetry|).
+	Retry *RetryOptions
+}
+
+var (
+	GDefaultWriteFileOptions = WriteFileOptions{
+		CreateDir:         false,
+		CreateDirFileMode: 0755,
+		SyncDir:           false,
+		Retry:             nil,
+	}
+)
+
+// RewriteFileAdvanced is like |RewriteFile| but permits to create the parent directory first.
+func RewriteFileAdvanced(path, content string, options *WriteFileOptions) error {
+	if options == nil {
+		options = &GDefaultWriteFileOptions
+	}
+
+	if options.CreateDir {
+		if err := EnsureParentDir(path, options.CreateDirFileMode); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(extendedLengthPath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("opening %q: %w", path, err)
 	}
@@ -29,12 +231,42 @@ func RewriteFile(path, content string) error {
 		return fmt.Errorf("rewriting file: %w", err)
 	}
 
+	if options.SyncDir {
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("closing %q: %w", path, err)
+		}
+
+		if err := syncParentDir(extendedLengthPath(path)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// RewriteFileIfChanged writes |content| to |path| only if the file does not exist already with that
+// exact content. Unlike |RewriteFile|, the content is written verbatim (not trimmed).
+// Returns whether the file was written.
+func RewriteFileIfChanged(path, content string) (bool, error) {
+	current, err := os.ReadFile(extendedLengthPath(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	if err == nil && string(current) == content {
+		return false, nil
+	}
+
+	if err := os.WriteFile(extendedLengthPath(path), []byte(content), 0644); err != nil {
+		return false, fmt.Errorf("writing %q: %w", path, err)
+	}
+
+	return true, nil
+}
+
 // DirExists check whether the directory exists and is a directory (not another type of file).
 func DirExists(path string) (bool, error) {
-	info, err := os.Stat(path)
+	info, err := os.Stat(extendedLengthPath(path))
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return false, fmt.Errorf("stating path %q: %w", path, err)
@@ -46,6 +278,68 @@ func DirExists(path string) (bool, error) {
 	return info.IsDir(), nil
 }
 
+// DirEmpty checks whether the directory at |path| has no entries. Only a single entry is read, so
+// this is cheap even for huge directories. Returns an error if |path| is not a directory.
+func DirEmpty(path string) (bool, error) {
+	dir, err := os.Open(extendedLengthPath(path))
+	if err != nil {
+		return false, fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer dir.Close()
+
+	info, err := dir.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stating path %q: %w", path, err)
+	}
+
+	if !info.IsDir() {
+		return false, fmt.Errorf("%q is not a directory", path)
+	}
+
+	if _, err := dir.Readdirnames(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+
+		return false, fmt.Errorf("reading dir %q: %w", path, err)
+	}
+
+	return false, nil
+}
+
+// UniqueFilename returns a path within |dir| for |base| that does not exist at the moment. If
+// |base| is taken, a numeric suffix is added before the extension ("foo.txt", "foo (1).txt",
+// "foo (2).txt", ...).
+// NOTE: This is best-effort and not atomic: another process could create the returned path before
+// the caller does. Use |os.O_EXCL| when creating it if that matters.
+func UniqueFilename(dir, base string) (string, error) {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	// Dotfiles (eg. ".bashrc") are all extension.
+	if stem == "" {
+		stem, ext = base, ""
+	}
+
+	const maxAttempts = 10000
+	for i := 0; i < maxAttempts; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+
+		path := filepath.Join(dir, name)
+		_, err := os.Lstat(extendedLengthPath(path))
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("lstat %q: %w", path, err)
+		}
+	}
+
+	return "", fmt.Errorf("finding unique filename for %q in %q: too many collisions", base, dir)
+}
+
 // DeleteFile is a convenience function that ignores the error if the file didn't exist already.
 func DeleteFile(path string) error {
 	if err := os.Remove(path); err != nil {
@@ -61,8 +355,35 @@ func DeleteFile(path string) error {
 
 // StatFile returns the file info of the file if it can be done.
 // If the file does not exists, the returned file info will be nil.
+// Symlinks are followed, see |StatFileAdvanced| for inspecting the links themselves.
 func StatFile(path string) (fs.FileInfo, bool, error) {
-	stat, err := os.Stat(path)
+	return StatFileAdvanced(path, nil)
+}
+
+type StatFileOptions struct {
+	// FollowSymlinks determines whether to stat the target of a symlink (|os.Stat|) or the link
+	// itself (|os.Lstat|).
+	FollowSymlinks bool
+}
+
+var (
+	GDefaultStatFileOptions = StatFileOptions{
+		FollowSymlinks: true,
+	}
+)
+
+// StatFileAdvanced is like |StatFile| but permits to choose whether to follow symlinks.
+func StatFileAdvanced(path string, options *StatFileOptions) (fs.FileInfo, bool, error) {
+	if options == nil {
+		options = &GDefaultStatFileOptions
+	}
+
+	stat := os.Stat
+	if !options.FollowSymlinks {
+		stat = os.Lstat
+	}
+
+	info, err := stat(extendedLengthPath(path))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, false, nil
@@ -71,7 +392,72 @@ func StatFile(path string) (fs.FileInfo, bool, error) {
 		}
 	}
 
-	return stat, true, nil
+	return info, true, nil
+}
+
+// ResolvePath returns the absolute path of |path| with all the symlinks resolved.
+func ResolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("resolving symlinks of %q: %w", path, err)
+	}
+
+	abs, err := filepath.Abs(resolved)
+	if err != nil {
+		return "", fmt.Errorf("abs %q: %w", resolved, err)
+	}
+
+	return abs, nil
+}
+
+// FileDetails is a richer version of |fs.FileInfo| returned by |StatFileInfo|.
+type FileDetails struct {
+	fs.FileInfo
+
+	// AbsPath is the absolute path of the file.
+	AbsPath string
+	// IsSymlink is whether the path itself is a symlink. The embedded |fs.FileInfo| always refers to
+	// the target of the link.
+	IsSymlink bool
+	// IsExecutable is whether any execute bit is set. On Windows, where there are no such bits, this
+	// is determined by the extension (.exe, .com, .bat, .cmd).
+	IsExecutable bool
+}
+
+// StatFileInfo is like |StatFile| but returns a |FileDetails| with some pre-computed fields.
+// If the file does not exists, the returned details will be nil.
+func StatFileInfo(path string) (*FileDetails, bool, error) {
+	stat, found, err := StatFile(path)
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	lstat, found, err := StatFileAdvanced(path, &StatFileOptions{FollowSymlinks: false})
+	if err != nil || !found {
+		return nil, false, StatFileErrorf(err, "lstat %q", path)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("abs %q: %w", path, err)
+	}
+
+	details := &FileDetails{
+		FileInfo:  stat,
+		AbsPath:   abs,
+		IsSymlink: lstat.Mode()&fs.ModeSymlink != 0,
+	}
+
+	if runtime.GOOS == "windows" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".exe", ".com", ".bat", ".cmd":
+			details.IsExecutable = !stat.IsDir()
+		}
+	} else {
+		details.IsExecutable = !stat.IsDir() && stat.Mode().Perm()&0111 != 0
+	}
+
+	return details, true, nil
 }
 
 // StatFileErrorf is an utility function to deal with the two possible error modes of |StatFile|.
@@ -107,6 +493,41 @@ type CopyFileAdvancedOptions struct {
 
 	// Sync ensures any buffered data is sent immediatelly.
 	Sync bool
+
+	// PreserveExecutable copies the execute bits of |src| onto |dst|. This is a targeted (and
+	// cheaper) alternative to preserve the full mode, useful for scripts and binaries.
+	PreserveExecutable bool
+
+	// Mode, if non-zero, is the exact permissions |dst| ends up with, regardless of the process umask
+	// or whether |dst| already existed. Takes precedence over |PreserveExecutable|.
+	Mode fs.FileMode
+
+	// Chown sets the owner of |dst| after the copy. Only supported on Unix, other platforms return
+	// an error wrapping |errors.ErrUnsupported|.
+	Chown *Ownership
+
+	// Atomic writes the data into a temporary file next to |dst|, which is renamed over |dst| only
+	// once the copy succeeded. Readers of |dst| never observe a partial copy.
+	Atomic bool
+
+	// SyncDir calls sync on the parent directory of |dst| once the copy is done (after the rename,
+	// if |Atomic| is used). Some filesystems need this to durably persist the rename across a power
+	// loss, which |Sync| alone does not guarantee. No-op on Windows.
+	SyncDir bool
+
+	// Retry, if set, retries the rename (for |Atomic|) and the cleanup of failed copies on transient
+	// errors, such as Windows antivirus holding a lock on the file. See |WithRetry|.
+	Retry *RetryOptions
+
+	// SkipIfSrcMissing makes the copy a no-op (rather than an error) if |src| does not exist, similar
+	// to |DeleteFile|. See |CopyFileCounted| to know whether the copy was skipped.
+	SkipIfSrcMissing bool
+}
+
+// Ownership identifies the user and group owning a file.
+type Ownership struct {
+	UID int
+	GID int
 }
 
 var (
@@ -114,86 +535,553 @@ var (
 		DstCreateDir:         false,
 		DstCreateDirFileMode: 0755,
 		Sync:                 false,
+		PreserveExecutable:   false,
+		Mode:                 0,
+		Chown:                nil,
+		Atomic:               false,
+		SyncDir:              false,
+		Retry:                nil,
+		SkipIfSrcMissing:     false,
 	}
 )
 
 func CopyFileAdvanced(src, dst string, options *CopyFileAdvancedOptions) error {
-	if options == nil {
-		options = &GDefaultCopyFileAdvancedOptions
+	return CopyFileAdvancedContext(context.Background(), src, dst, options)
+}
+
+// CopyFileAdvancedContext is like |CopyFileAdvanced|, but it will stop copying as soon as |ctx| is
+// cancelled, returning |ctx.Err()|.
+//
+// If the copy fails after the destination was created by this call, the partial destination is
+// removed. A pre-existing destination is never removed, though it might be left truncated (unless
+// |Atomic| is used, in which case it is left untouched).
+func CopyFileAdvancedContext(ctx context.Context, src, dst string, options *CopyFileAdvancedOptions) error {
+	_, err := copyFile(ctx, src, dst, options)
+	return err
+}
+
+// CopyFileCounted is like |CopyFileAdvancedContext|, but also returns the amount of bytes written.
+// If the copy was skipped because of |SkipIfSrcMissing|, -1 is returned.
+func CopyFileCounted(ctx context.Context, src, dst string, options *CopyFileAdvancedOptions) (int64, error) {
+	return copyFile(ctx, src, dst, options)
+}
+
+// CopyReaderToFile writes all the content of |r| into |dst|, following |options| like
+// |CopyFileAdvanced| does. As there is no source file, |PreserveExecutable| has no effect.
+// Returns the amount of bytes written.
+func CopyReaderToFile(r io.Reader, dst string, options *CopyFileAdvancedOptions) (int64, error) {
+	return writeToFile(context.Background(), r, 0, dst, options)
+}
+
+// CopyFileToWriter writes all the content of the file at |src| into |w|.
+// Returns the amount of bytes written.
+func CopyFileToWriter(src string, w io.Writer) (int64, error) {
+	srcFile, err := os.Open(extendedLengthPath(src))
+	if err != nil {
+		return 0, fmt.Errorf("opening %q: %w", src, err)
+	}
+	defer srcFile.Close()
+
+	written, err := io.Copy(w, srcFile)
+	if err != nil {
+		return written, fmt.Errorf("copying data from %q: %w", src, err)
+	}
+
+	return written, nil
+}
+
+// ReadFileRange reads |length| bytes from the file at |path| starting at |offset|, without loading
+// the rest of the file. A |length| of -1 reads until the end of the file. If the file is shorter
+// than requested, the available bytes are returned (possibly none) without error.
+func ReadFileRange(path string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < -1 {
+		return nil, fmt.Errorf("reading %q: invalid range (offset %d, length %d)", path, offset, length)
 	}
 
-	srcFile, err := os.Open(src)
+	file, err := os.Open(extendedLengthPath(path))
 	if err != nil {
-		return fmt.Errorf("opening %q: %w", src, err)
+		return nil, fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seeking %q to %d: %w", path, offset, err)
+	}
+
+	var r io.Reader = file
+	if length >= 0 {
+		r = io.LimitReader(file, length)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	return data, nil
+}
+
+// ReadFileContext is like |os.ReadFile|, but the file is read in chunks and reading stops as soon as
+// |ctx| is cancelled, returning |ctx.Err()|. A read blocked within a single syscall cannot be
+// interrupted, but this gives cancellation points for big files or slow filesystems (eg. NFS).
+func ReadFileContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(extendedLengthPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	if stat, err := file.Stat(); err == nil {
+		buf.Grow(int(stat.Size()))
+	}
+
+	// We read explicitly in chunks, as |bytes.Buffer.ReadFrom| would try to read everything at once.
+	chunk := make([]byte, 64*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, err := file.Read(chunk)
+		buf.Write(chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", path, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// copyFile implements |CopyFileAdvancedContext|, also returning the amount of bytes written (see
+// |CopyFileCounted|).
+func copyFile(ctx context.Context, src, dst string, options *CopyFileAdvancedOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	srcFile, err := os.Open(extendedLengthPath(src))
+	if err != nil {
+		if options != nil && options.SkipIfSrcMissing && errors.Is(err, fs.ErrNotExist) {
+			return -1, nil
+		}
+		return 0, fmt.Errorf("opening %q: %w", src, err)
 	}
 	defer srcFile.Close()
 
+	srcStat, err := srcFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("statting %q: %w", src, err)
+	}
+
+	written, err := writeToFile(ctx, srcFile, srcStat.Mode().Perm()&0111, dst, options)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		return 0, fmt.Errorf("copying %q: %w", src, err)
+	}
+
+	return written, nil
+}
+
+// writeToFile writes the content of |r| into |dst| following |options|. |execBits| are the
+// execute bits to apply when |PreserveExecutable| is set.
+func writeToFile(ctx context.Context, r io.Reader, execBits fs.FileMode, dst string, options *CopyFileAdvancedOptions) (written int64, retErr error) {
+	if options == nil {
+		options = &GDefaultCopyFileAdvancedOptions
+	}
+
 	if options.DstCreateDir {
-		dir := filepath.Dir(dst)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("mkdirall %q: %w", dir, err)
+		if err := EnsureParentDir(dst, options.DstCreateDirFileMode); err != nil {
+			return 0, err
 		}
 	}
 
-	// Create (or truncate) the destination file.
-	dstFile, err := os.Create(dst)
+	// |target| is where we actually write: either |dst| or a temporary file when |Atomic| is used.
+	target := dst
+	var dstFile *os.File
+	var cleanup bool
+	if options.Atomic {
+		tmp, err := createTempSibling(dst)
+		if err != nil {
+			return 0, err
+		}
+
+		dstFile = tmp
+		target = tmp.Name()
+		cleanup = true
+	} else {
+		// We track whether this call is the one creating the file, as we only want to clean up those.
+		_, statErr := os.Lstat(extendedLengthPath(dst))
+		cleanup = errors.Is(statErr, fs.ErrNotExist)
+
+		// Create (or truncate) the destination file.
+		perm := fs.FileMode(0666)
+		if options.Mode != 0 {
+			perm = options.Mode.Perm()
+		}
+		f, err := os.OpenFile(extendedLengthPath(dst), os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return 0, fmt.Errorf("opening %q: %w", dst, err)
+		}
+		dstFile = f
+	}
+
+	closed := false
+	defer func() {
+		if !closed {
+			dstFile.Close()
+		}
+		if retErr != nil && cleanup {
+			// Best effort. We don't want to shadow the original error.
+			options.Retry.retry(func() error {
+				return os.Remove(extendedLengthPath(target))
+			})
+		}
+	}()
+
+	written, err := io.Copy(dstFile, &contextReader{ctx: ctx, r: r})
 	if err != nil {
-		return fmt.Errorf("opening %q: %w", dst, err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		return 0, fmt.Errorf("copying data to %q: %w", dst, err)
 	}
-	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("copying data from %q to %q: %w", src, dst, err)
+	if options.Mode != 0 {
+		// The mode used on creation is subject to the umask and ignored for existing files.
+		if err := dstFile.Chmod(options.Mode.Perm()); err != nil {
+			return 0, fmt.Errorf("chmod %q: %w", dst, err)
+		}
+	} else if options.PreserveExecutable && execBits != 0 {
+		if err := addPermBits(dstFile, execBits); err != nil {
+			return 0, fmt.Errorf("preserving executable bits on %q: %w", dst, err)
+		}
+	}
+
+	if options.Chown != nil {
+		if err := chownFile(dstFile, options.Chown); err != nil {
+			return 0, fmt.Errorf("chown %q: %w", dst, err)
+		}
 	}
 
 	if options.Sync {
 		if err := dstFile.Sync(); err != nil {
-			return fmt.Errorf("calling sync on %q: %w", dst, err)
+			return 0, fmt.Errorf("calling sync on %q: %w", dst, err)
+		}
+	}
+
+	closed = true
+	if err := dstFile.Close(); err != nil {
+		return 0, fmt.Errorf("closing %q: %w", target, err)
+	}
+
+	if options.Atomic {
+		err := options.Retry.retry(func() error {
+			return os.Rename(extendedLengthPath(target), extendedLengthPath(dst))
+		})
+		if err != nil {
+			return 0, fmt.Errorf("renaming %q -> %q: %w", target, dst, err)
+		}
+	}
+
+	if options.SyncDir {
+		if err := syncParentDir(extendedLengthPath(dst)); err != nil {
+			return 0, err
 		}
 	}
 
+	return written, nil
+}
+
+// addPermBits ORs |bits| onto the permissions of |file|.
+func addPermBits(file *os.File, bits fs.FileMode) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("statting: %w", err)
+	}
+
+	if err := file.Chmod(stat.Mode().Perm() | bits); err != nil {
+		return fmt.Errorf("chmod: %w", err)
+	}
+
 	return nil
 }
 
 // CopyDirRecursive copies all the content of a directory into another path.
+// |to| cannot be |from| or be located within it.
 func CopyDirRecursive(from, to string) error {
+	return CopyDirRecursiveContext(context.Background(), from, to)
+}
+
+// CopyDirRecursiveContext is like |CopyDirRecursive|, but checks |ctx| between (and within) file
+// copies. On cancellation it stops promptly and returns |ctx.Err()|.
+func CopyDirRecursiveContext(ctx context.Context, from, to string) error {
+	_, err := CopyDirRecursiveAdvanced(ctx, from, to, nil)
+	return err
+}
+
+type CopyDirRecursiveAdvancedOptions struct {
+	// ContinueOnError makes the copy go on when a single file fails to copy. The failures are
+	// recorded in |CopyDirResult.Errors| and the file is counted as skipped.
+	// Context cancellation always stops the copy.
+	ContinueOnError bool
+
+	// Walk controls how the source directory is traversed (eg. skipping hidden files).
+	Walk WalkOptions
+
+	// DryRun performs all the planning but doesn't write anything. The returned result reports what
+	// would have happened (eg. |BytesCopied| is the amount of bytes that would be copied).
+	DryRun bool
+
+	// FileOptions are used for copying each of the files. |DstCreateDir| is always enabled.
+	FileOptions CopyFileAdvancedOptions
+
+	// PreserveEmptyDirs also recreates the directories of the source at the destination, using
+	// |FileOptions.DstCreateDirFileMode|. Otherwise directories are only created as parents of the
+	// copied files, so empty ones are not copied.
+	PreserveEmptyDirs bool
+
+	// Transform, if set, is called with the relative (Unix) path and the full content of each file,
+	// and what it returns is written to the destination instead. Files it returns unchanged are
+	// copied as usual. It is not called on |DryRun|, where the sizes reported are the source ones.
+	Transform func(relPath string, content []byte) ([]byte, error)
+
+	// Unsorted skips sorting the files before copying them, so they are copied in whatever order the
+	// walk found them. This saves some time on huge trees when the copy order does not matter.
+	Unsorted bool
+}
+
+var (
+	GDefaultCopyDirRecursiveAdvancedOptions = CopyDirRecursiveAdvancedOptions{
+		ContinueOnError:   false,
+		Walk:              GDefaultWalkOptions,
+		DryRun:            false,
+		FileOptions:       GDefaultCopyFileAdvancedOptions,
+		Transform:         nil,
+		PreserveEmptyDirs: false,
+		Unsorted:          false,
+	}
+)
+
+// CopyDirResult is a summary of what |CopyDirRecursiveAdvanced| did.
+type CopyDirResult struct {
+	FilesCopied  int
+	FilesSkipped int
+	// FilesOverwritten is how many of the copied files already existed at the destination.
+	FilesOverwritten int
+	BytesCopied      int64
+	// Errors holds the per-file errors when |ContinueOnError| is used.
+	Errors []error
+}
+
+// CopyDirRecursiveAdvanced is like |CopyDirRecursiveContext|, but also returns a summary of the
+// copy. The result is returned even on error, reflecting the work done until then. When
+// |ContinueOnError| is used and some files failed, the returned error joins all of them.
+//
+// Unless |Unsorted| is set, the files are copied in lexical order of their relative Unix paths, so
+// the side effects of the copy (eg. |Transform| calls or the order of |CopyDirResult.Errors|) are
+// reproducible.
+func CopyDirRecursiveAdvanced(ctx context.Context, from, to string, options *CopyDirRecursiveAdvancedOptions) (*CopyDirResult, error) {
+	if options == nil {
+		options = &GDefaultCopyDirRecursiveAdvancedOptions
+	}
+
+	result := &CopyDirResult{}
+
+	// Copying into the source would make the walk recurse into its own output.
+	inside, err := IsSubPath(from, to)
+	if err != nil {
+		return result, err
+	}
+	if inside {
+		return result, fmt.Errorf("destination %q is within source %q", to, from)
+	}
+
 	// TODO(cdc): Make this use errgroup.
 	from = filepath.Clean(from)
 
 	var files []string
-	err := filepath.WalkDir(from, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
+	var dirs []string
+	err = walkRelativeAdvanced(from, &options.Walk, func(rel string, d fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
 		if d.IsDir() {
+			if options.PreserveEmptyDirs {
+				dirs = append(dirs, rel)
+			}
 			return nil
 		}
 
-		// Remove the prefix from the path.
-		path = ToUnixPath(strings.TrimPrefix(path, from))
-		path = strings.TrimPrefix(path, "/")
-		files = append(files, path)
+		files = append(files, rel)
 		return nil
 	})
 
 	if err != nil {
-		return fmt.Errorf("walking %q: %w", from, err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return result, ctxErr
+		}
+		return result, err
+	}
+
+	if !options.Unsorted {
+		sort.Strings(files)
 	}
 
 	to = filepath.Clean(to)
 
+	if options.PreserveEmptyDirs && !options.DryRun {
+		mode := options.FileOptions.DstCreateDirFileMode
+		if mode == 0 {
+			mode = 0755
+		}
+
+		// "." makes sure that even an empty source produces a destination.
+		for _, dir := range append([]string{"."}, dirs...) {
+			dst := filepath.Join(to, filepath.FromSlash(dir))
+			if err := os.MkdirAll(extendedLengthPath(dst), mode); err != nil {
+				return result, fmt.Errorf("creating dir %q: %w", dst, err)
+			}
+		}
+	}
+
 	for _, file := range files {
 		src := filepath.Join(from, file)
 		dst := filepath.Join(to, file)
 
-		options := CopyFileAdvancedOptions{
-			DstCreateDir: true,
+		written, overwrote, err := copyDirFile(ctx, file, src, dst, options)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return result, ctxErr
+			}
+
+			err = fmt.Errorf("copying %q -> %q: %w", src, dst, err)
+			if !options.ContinueOnError {
+				return result, err
+			}
+
+			result.FilesSkipped++
+			result.Errors = append(result.Errors, err)
+			continue
 		}
-		if err := CopyFileAdvanced(src, dst, &options); err != nil {
-			return fmt.Errorf("copying %q -> %q: %w", src, dst, err)
+
+		// The file was removed since the walk and |SkipIfSrcMissing| is set.
+		if written < 0 {
+			result.FilesSkipped++
+			continue
+		}
+
+		result.FilesCopied++
+		result.BytesCopied += written
+		if overwrote {
+			result.FilesOverwritten++
 		}
 	}
 
-	return nil
+	if len(result.Errors) > 0 {
+		return result, fmt.Errorf("%d files failed to copy: %w", len(result.Errors), errors.Join(result.Errors...))
+	}
+
+	return result, nil
+}
+
+// copyDirFile copies a single file (at |rel| within the copied tree) for |CopyDirRecursiveAdvanced|,
+// also reporting whether |dst| existed already. On |DryRun| nothing is written and the size of
+// |src| is reported instead.
+func copyDirFile(ctx context.Context, rel, src, dst string, options *CopyDirRecursiveAdvancedOptions) (int64, bool, error) {
+	_, existed, err := StatFile(dst)
+	if err != nil {
+		return 0, false, fmt.Errorf("statting %q: %w", dst, err)
+	}
+
+	if options.DryRun {
+		stat, found, err := StatFile(src)
+		if err == nil && !found && options.FileOptions.SkipIfSrcMissing {
+			return -1, existed, nil
+		}
+		if err != nil || !found {
+			return 0, false, StatFileErrorf(err, "statting %q", src)
+		}
+
+		return stat.Size(), existed, nil
+	}
+
+	fileOptions := options.FileOptions
+	fileOptions.DstCreateDir = true
+
+	if options.Transform != nil {
+		written, transformed, err := transformFile(ctx, rel, src, dst, options.Transform, &fileOptions)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if transformed {
+			return written, existed, nil
+		}
+	}
+
+	written, err := copyFile(ctx, src, dst, &fileOptions)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return written, existed, nil
+}
+
+// transformFile writes the result of |transform| over the content of |src| into |dst|. If the
+// content is unchanged nothing is written, and false is returned.
+func transformFile(ctx context.Context, rel, src, dst string, transform func(string, []byte) ([]byte, error), options *CopyFileAdvancedOptions) (int64, bool, error) {
+	stat, found, err := StatFile(src)
+	if err == nil && !found && options.SkipIfSrcMissing {
+		return -1, true, nil
+	}
+	if err != nil || !found {
+		return 0, false, StatFileErrorf(err, "statting %q", src)
+	}
+
+	content, err := os.ReadFile(extendedLengthPath(src))
+	if err != nil {
+		return 0, false, fmt.Errorf("reading %q: %w", src, err)
+	}
+
+	transformed, err := transform(rel, content)
+	if err != nil {
+		return 0, false, fmt.Errorf("transforming %q: %w", rel, err)
+	}
+
+	if bytes.Equal(content, transformed) {
+		return 0, false, nil
+	}
+
+	written, err := writeToFile(ctx, bytes.NewReader(transformed), stat.Mode().Perm()&0111, dst, options)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return written, true, nil
+}
+
+// contextReader is an |io.Reader| that fails as soon as the associated context is cancelled.
+// This gives cancellation points between the chunks |io.Copy| reads.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
 }
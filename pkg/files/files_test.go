@@ -0,0 +1,162 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var errTestRead = errors.New("test read error")
+
+// failingReader returns |data| and then fails, simulating an error in the middle of a copy.
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errTestRead
+	}
+
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestCopyReaderToFileFailureRemovesCreatedFile(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "dst.txt")
+
+	_, err := CopyReaderToFile(&failingReader{data: []byte("partial")}, dst, nil)
+	if !errors.Is(err, errTestRead) {
+		t.Fatalf("CopyReaderToFile() = %v, want %v", err, errTestRead)
+	}
+
+	if _, err := os.Lstat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial destination %q was left behind (stat: %v)", dst, err)
+	}
+}
+
+func TestCopyReaderToFileFailureKeepsExistingFile(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		dir := t.TempDir()
+		dst := filepath.Join(dir, "dst.txt")
+		writeTestFile(t, dst, []byte("original"))
+
+		options := GDefaultCopyFileAdvancedOptions
+		options.Atomic = atomic
+
+		_, err := CopyReaderToFile(&failingReader{data: []byte("partial")}, dst, &options)
+		if !errors.Is(err, errTestRead) {
+			t.Fatalf("CopyReaderToFile(atomic: %t) = %v, want %v", atomic, err, errTestRead)
+		}
+
+		data, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatalf("pre-existing destination (atomic: %t) was removed: %v", atomic, err)
+		}
+
+		// Only the atomic mode can preserve the original content.
+		if atomic && string(data) != "original" {
+			t.Errorf("destination content (atomic: %t) = %q, want %q", atomic, data, "original")
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("temporary files (atomic: %t) were left behind: %v", atomic, entries)
+		}
+	}
+}
+
+func TestCopyReaderToFile(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "dst.txt")
+
+	written, err := CopyReaderToFile(io.LimitReader(&failingReader{data: []byte("content")}, 7), dst, nil)
+	if err != nil {
+		t.Fatalf("CopyReaderToFile(): %v", err)
+	}
+
+	if written != 7 {
+		t.Errorf("CopyReaderToFile() wrote %d bytes, want 7", written)
+	}
+
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "content" {
+		t.Errorf("ReadFile(%q) = %q, %v, want %q", dst, data, err, "content")
+	}
+}
+
+func TestCopyDirRecursiveIntoItself(t *testing.T) {
+	from := filepath.Join(t.TempDir(), "a")
+	if err := os.MkdirAll(from, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(from, "file.txt"), []byte("content"))
+
+	for _, to := range []string{filepath.Join(from, "backup"), from} {
+		if err := CopyDirRecursive(from, to); err == nil {
+			t.Errorf("CopyDirRecursive(%q, %q) succeeded, want an error", from, to)
+		}
+	}
+
+	// Nothing should have been copied.
+	if _, err := os.Lstat(filepath.Join(from, "backup")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CopyDirRecursive created the destination within the source (stat: %v)", err)
+	}
+}
+
+func TestToNativePath(t *testing.T) {
+	testCases := []struct {
+		path        string
+		wantUnix    string
+		wantWindows string
+	}{
+		{path: "", wantUnix: "", wantWindows: ""},
+		{path: "foo", wantUnix: "foo", wantWindows: "foo"},
+		{path: "foo/bar/baz.txt", wantUnix: "foo/bar/baz.txt", wantWindows: `foo\bar\baz.txt`},
+		{path: "/abs/path/", wantUnix: "/abs/path/", wantWindows: `\abs\path\`},
+		{path: "C:/Users/me", wantUnix: "C:/Users/me", wantWindows: `C:\Users\me`},
+		// Backslashes are only converted by |ToUnixPath|, never by |ToNativePath|.
+		{path: `foo\bar`, wantUnix: `foo\bar`, wantWindows: `foo\bar`},
+	}
+
+	for _, tc := range testCases {
+		want := tc.wantUnix
+		if runtime.GOOS == "windows" {
+			want = tc.wantWindows
+		}
+
+		if got := ToNativePath(tc.path); got != want {
+			t.Errorf("ToNativePath(%q) = %q, want %q", tc.path, got, want)
+		}
+	}
+}
+
+func TestToNativePathRoundTrip(t *testing.T) {
+	paths := []string{
+		"",
+		"foo",
+		filepath.Join("foo", "bar", "baz.txt"),
+		filepath.Join(string(filepath.Separator)+"abs", "path"),
+		filepath.Join(t.TempDir(), "file.txt"),
+	}
+	if runtime.GOOS == "windows" {
+		paths = append(paths, `C:\Users\me`, `\\server\share\file.txt`)
+	}
+
+	for _, path := range paths {
+		unix := ToUnixPath(path)
+		if strings.Contains(unix, `\`) {
+			t.Errorf("ToUnixPath(%q) = %q, contains backslashes", path, unix)
+		}
+
+		if got := ToNativePath(unix); got != path {
+			t.Errorf("ToNativePath(ToUnixPath(%q)) = %q, want the original path", path, got)
+		}
+	}
+}
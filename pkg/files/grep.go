@@ -0,0 +1,56 @@
+package files
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ErrStopGrep can be returned by the |GrepFile| callback to stop the search early. |GrepFile| will
+// then return nil.
+var ErrStopGrep = errors.New("stop grep")
+
+// GrepFile streams the file at |path| and calls |fn| with the 1-based line number and the content of
+// every line matching |re|. As with |LoadedFile.Lines|, the line terminators are not included.
+// Unlike loading the file, this never holds more than a line in memory, and there is no limit on the
+// line length.
+func GrepFile(path string, re *regexp.Regexp, fn func(lineNo int, line string) error) error {
+	file, err := os.Open(extendedLengthPath(path))
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNo := 1; ; lineNo++ {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("reading %q: %w", path, readErr)
+		}
+
+		// The final newline does not start a new line.
+		if readErr == io.EOF && line == "" {
+			return nil
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+
+		if re.MatchString(line) {
+			if err := fn(lineNo, line); err != nil {
+				if errors.Is(err, ErrStopGrep) {
+					return nil
+				}
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
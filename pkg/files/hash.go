@@ -0,0 +1,101 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// HashFile returns the hex encoded sha256 of the content of the file at |path|.
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("hashing %q: %w", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DirHash returns a single hex encoded sha256 that represents the content and structure of the
+// whole directory tree under |root|. Conceptually it is similar to Go's module dirhash: each file is
+// hashed on its own and then a summary of "<hash> <mode> <relative unix path>" lines, sorted by path,
+// is hashed again. This means that identical trees give identical hashes, regardless of the walk
+// order or the platform separators.
+//
+// Symlinks are not followed: a symlink (to a file or a directory) is hashed by its target path, as
+// git does. Other non-regular files (eg. FIFOs or sockets) are skipped.
+func DirHash(root string) (string, error) {
+	return DirHashParallel(root, 1)
+}
+
+// DirHashParallel is like |DirHash|, but hashes the individual files with |concurrency| workers.
+// If |concurrency| is not positive, |runtime.NumCPU| is used. The result is the same as |DirHash|
+// regardless of the amount of workers.
+func DirHashParallel(root string, concurrency int) (string, error) {
+	entries, err := ListFilesRecursive(root)
+	if err != nil {
+		return "", err
+	}
+
+	type result struct {
+		hash string
+		mode fs.FileMode
+		skip bool
+		err  error
+	}
+	results := make([]result, len(entries))
+
+	parallelFor(len(entries), concurrency, func(index int) {
+		path := filepath.Join(root, filepath.FromSlash(entries[index]))
+
+		stat, err := os.Lstat(path)
+		if err != nil {
+			results[index].err = fmt.Errorf("statting %q: %w", path, err)
+			return
+		}
+		results[index].mode = stat.Mode()
+
+		switch {
+		case stat.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				results[index].err = fmt.Errorf("reading link %q: %w", path, err)
+				return
+			}
+
+			sum := sha256.Sum256([]byte(ToUnixPath(target)))
+			results[index].hash = hex.EncodeToString(sum[:])
+		case !stat.Mode().IsRegular():
+			// Reading a FIFO could hang, and devices or sockets have no meaningful content.
+			results[index].skip = true
+		default:
+			results[index].hash, results[index].err = HashFile(path)
+		}
+	})
+
+	// We combine in the (sorted) order of the entries, so the result is deterministic.
+	h := sha256.New()
+	for i, entry := range entries {
+		if results[i].err != nil {
+			return "", results[i].err
+		}
+
+		if results[i].skip {
+			continue
+		}
+
+		fmt.Fprintf(h, "%s %s %s\n", results[i].hash, results[i].mode, entry)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
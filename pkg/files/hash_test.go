@@ -0,0 +1,56 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeHashTestDir creates a tree with a file and a symlink (pointing to |linkTarget|) to a
+// directory.
+func makeHashTestDir(t *testing.T, linkTarget string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for _, dir := range []string{"dir", "other"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(root, "dir", "file.txt"), []byte("content"))
+
+	if err := os.Symlink(linkTarget, filepath.Join(root, "link")); err != nil {
+		t.Skipf("creating symlink: %v", err)
+	}
+
+	return root
+}
+
+func TestDirHashSymlinkedDir(t *testing.T) {
+	root := makeHashTestDir(t, "dir")
+
+	hash, err := DirHash(root)
+	if err != nil {
+		t.Fatalf("DirHash(%q): %v", root, err)
+	}
+
+	parallel, err := DirHashParallel(root, 4)
+	if err != nil {
+		t.Fatalf("DirHashParallel(%q): %v", root, err)
+	}
+	if parallel != hash {
+		t.Errorf("DirHashParallel(%q) = %q, want %q (same as DirHash)", root, parallel, hash)
+	}
+
+	// The same tree elsewhere gives the same hash, as the link is hashed by its (relative) target.
+	same := makeHashTestDir(t, "dir")
+	if got, err := DirHash(same); err != nil || got != hash {
+		t.Errorf("DirHash(%q) = %q, %v, want %q", same, got, err, hash)
+	}
+
+	// Retargeting the link changes the hash.
+	retargeted := makeHashTestDir(t, "other")
+	if got, err := DirHash(retargeted); err != nil || got == hash {
+		t.Errorf("DirHash(%q) = %q, %v, want a hash different from %q", retargeted, got, err, hash)
+	}
+}
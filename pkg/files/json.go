@@ -0,0 +1,42 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// WriteJSONFile marshals |v| and writes it atomically (see |WriteFileAtomic|) to |path|. If |indent|
+// is true, the output is indented with two spaces.
+func WriteJSONFile(path string, v any, indent bool) error {
+	var data []byte
+	var err error
+	if indent {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Errorf("marshalling json for %q: %w", path, err)
+	}
+
+	if err := WriteFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadJSONFile reads the file at |path| and unmarshals it into |v|.
+func ReadJSONFile(path string, v any) error {
+	data, err := os.ReadFile(extendedLengthPath(path))
+	if err != nil {
+		return fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("unmarshalling json from %q: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrLazyFile is returned by the |LoadedFile| methods that need the whole content in memory when
+// called on a file loaded with |LoadFileLazy|.
+var ErrLazyFile = errors.New("not available for lazily loaded files")
+
+// lazyIndex backs a |LoadedFile| whose content is read from disk on demand.
+type lazyIndex struct {
+	path      string
+	size      int
+	lineCount int
+}
+
+// LoadFileLazy loads the file at |path| without holding its content in memory: only the line
+// offsets are computed (reading the file once in a streaming fashion) and each line is read from
+// disk when requested. This permits to use the position API over huge files with bounded memory.
+// The file is not cached and, as with |LoadFileUncached|, its key is the one |LoadFileFromPath|
+// would use.
+//
+// As |Data| is nil, not every method is supported:
+//   - Work as usual: |Line|, |LineStarts|, |LineAtOffset|, |LineRangeForByteSpan|,
+//     |DisplayColumn|, |LineRuneCount|, |LineByteLen|, |SubstringByteRange|, |IsStale| and the
+//     positions (including |LoadedFilePosition.Snippet|).
+//   - Fail with |ErrLazyFile|: |Lines| and everything built on top of it (|LinesFiltered|,
+//     |LineMap|, |Sections|), |Split| and |SplitFunc|.
+//   - Operate on the (empty) |Data|, so their results are meaningless: |HasBOM|, |DataWithoutBOM|,
+//     |LineEnding|, |HasFinalNewline|, |ContentType| (only the extension is used) and
+//     |WithReplaced|. Hashing the content requires reading it all anyway, use |HashFile|.
+//
+// Since lines are read on demand, modifying the file after loading it gives inconsistent results.
+// Use |IsStale| to detect that. |SetData| turns the file into a regular in-memory one.
+func LoadFileLazy(path string) (*LoadedFile, error) {
+	key, resolved, err := GlobalFileCache().keyForPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(extendedLengthPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("statting %q: %w", path, err)
+	}
+
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("loading %q (%s): %w", path, stat.Mode().Type(), ErrNotRegularFile)
+	}
+
+	starts := []int{0}
+	lineCount := 0
+	scanner := NewLineScanner(file)
+	for scanner.Scan() {
+		_, start, _ := scanner.Line()
+		if start > 0 {
+			starts = append(starts, int(start))
+		}
+		lineCount++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("indexing lines of %q: %w", path, err)
+	}
+
+	lf := NewLoadedFile(key, nil)
+	lf.FromFile = true
+	lf.path = resolved
+	lf.Stat = stat
+	lf.lineStarts = starts
+	lf.lazy = &lazyIndex{
+		// The absolute path, so that lines can still be read if the working directory changes.
+		path:      resolved,
+		size:      int(stat.Size()),
+		lineCount: lineCount,
+	}
+
+	return lf, nil
+}
+
+// line reads the 1-based line |n| from disk. |starts| are the line starts of the file, which are
+// passed in as they are guarded by the |LoadedFile|.
+func (li *lazyIndex) line(starts []int, n int) (string, error) {
+	if n < 1 || n > li.lineCount {
+		return "", fmt.Errorf("line %d out of range (file has %d lines)", n, li.lineCount)
+	}
+
+	start := starts[n-1]
+	end := li.size
+	if n < len(starts) {
+		end = starts[n]
+	}
+
+	data, err := ReadFileRange(li.path, int64(start), int64(end-start))
+	if err != nil {
+		return "", err
+	}
+
+	text := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(text, "\r"), nil
+}
+
+// dataLen returns the size of the content of the file, whether it is in memory or not.
+func (lf *LoadedFile) dataLen() int {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.lazy != nil {
+		return lf.lazy.size
+	}
+
+	return len(lf.Data)
+}
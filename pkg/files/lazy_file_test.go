@@ -0,0 +1,38 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFileLazyRelativePath(t *testing.T) {
+	dir := t.TempDir()
+	otherDir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "file.txt"), []byte("first\nsecond\n"))
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered after the temporary directories, so that it runs before they are removed.
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := LoadFileLazy("file.txt")
+	if err != nil {
+		t.Fatalf("LoadFileLazy(): %v", err)
+	}
+
+	// Lines are read on demand, which must not depend on the working directory.
+	if err := os.Chdir(otherDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := lf.Line(2); err != nil || got != "second" {
+		t.Errorf("Line(2) = %q, %v, want %q", got, err, "second")
+	}
+}
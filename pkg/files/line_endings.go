@@ -0,0 +1,129 @@
+package files
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// LineEndingStyle represents a line terminator convention.
+type LineEndingStyle int
+
+const (
+	// LineEndingNative is CRLF on Windows and LF everywhere else.
+	LineEndingNative LineEndingStyle = iota
+	// LineEndingLF is the Unix "\n".
+	LineEndingLF
+	// LineEndingCRLF is the Windows "\r\n".
+	LineEndingCRLF
+	// LineEndingPreserve is only meaningful when rewriting an existing file (see |RewriteFileLines|),
+	// and uses the ending detected in it. Otherwise it behaves like |LineEndingNative|.
+	LineEndingPreserve
+)
+
+// Terminator returns the actual line terminator string for the style.
+func (style LineEndingStyle) Terminator() string {
+	switch style {
+	case LineEndingLF:
+		return "\n"
+	case LineEndingCRLF:
+		return "\r\n"
+	}
+
+	if runtime.GOOS == "windows" {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+func (style LineEndingStyle) String() string {
+	switch style {
+	case LineEndingLF:
+		return "LF"
+	case LineEndingCRLF:
+		return "CRLF"
+	case LineEndingNative:
+		return "Native"
+	case LineEndingPreserve:
+		return "Preserve"
+	}
+
+	return fmt.Sprintf("LineEndingStyle(%d)", int(style))
+}
+
+// NormalizeLineEndings converts all the line endings in |content| to |style|. Mixed line endings are
+// all converted to the target.
+func NormalizeLineEndings(content string, style LineEndingStyle) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	if terminator := style.Terminator(); terminator != "\n" {
+		content = strings.ReplaceAll(content, "\n", terminator)
+	}
+
+	return content
+}
+
+// NormalizeFileLineEndings converts the line endings of the file at |path| to |style|. The file is
+// only rewritten if that changes anything, which is reported in |changed|.
+func NormalizeFileLineEndings(path string, style LineEndingStyle) (changed bool, err error) {
+	data, err := os.ReadFile(extendedLengthPath(path))
+	if err != nil {
+		return false, fmt.Errorf("reading %q: %w", path, err)
+	}
+
+	return RewriteFileIfChanged(path, NormalizeLineEndings(string(data), style))
+}
+
+// LineEnding returns the predominant line ending style of the file. |found| is false if the file
+// has no line endings at all, in which case |LineEndingNative| is returned.
+func (lf *LoadedFile) LineEnding() (style LineEndingStyle, found bool) {
+	total := bytes.Count(lf.Data, []byte("\n"))
+	if total == 0 {
+		return LineEndingNative, false
+	}
+
+	crlf := bytes.Count(lf.Data, []byte("\r\n"))
+	if crlf > total-crlf {
+		return LineEndingCRLF, true
+	}
+
+	return LineEndingLF, true
+}
+
+// RewriteFileLines writes |lines| to |path| atomically (see |WriteFileAtomic|), terminating each of
+// them (including the last one) with |ending|. If |ending| is |LineEndingPreserve| and the file
+// exists, the ending detected in it is used. The mode of an existing file is kept, otherwise 0644
+// is used.
+func RewriteFileLines(path string, lines []string, ending LineEndingStyle) error {
+	perm := fs.FileMode(0644)
+	stat, found, err := StatFile(path)
+	if err != nil {
+		return fmt.Errorf("statting %q: %w", path, err)
+	}
+
+	if found {
+		perm = stat.Mode().Perm()
+
+		if ending == LineEndingPreserve {
+			data, err := os.ReadFile(extendedLengthPath(path))
+			if err != nil {
+				return fmt.Errorf("reading %q: %w", path, err)
+			}
+
+			if detected, ok := NewLoadedFile(path, data).LineEnding(); ok {
+				ending = detected
+			}
+		}
+	}
+
+	var sb strings.Builder
+	terminator := ending.Terminator()
+	for _, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString(terminator)
+	}
+
+	return WriteFileAtomic(path, []byte(sb.String()), perm)
+}
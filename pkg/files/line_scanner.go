@@ -0,0 +1,72 @@
+package files
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LineScanner reads lines from an |io.Reader| in a streaming fashion, also reporting the line number
+// and the byte offset at which each line starts. This permits to build positions without having the
+// whole content in memory (see |LoadedFile.LineStarts| for the in-memory equivalent).
+// Lines follow the same conventions as |LoadedFile.Lines|: the terminator ("\n" or "\r\n") is not
+// included and a final newline does not produce an extra empty line. Unlike |bufio.Scanner|, there
+// is no limit on the length of a line.
+type LineScanner struct {
+	r *bufio.Reader
+
+	lineNo int
+	start  int64
+	text   string
+
+	// offset is where the next line starts.
+	offset int64
+	err    error
+}
+
+func NewLineScanner(r io.Reader) *LineScanner {
+	return &LineScanner{r: bufio.NewReader(r)}
+}
+
+// Scan advances to the next line, which is then available through |Line|. Returns false at the end
+// of the input or on error (see |Err|).
+func (ls *LineScanner) Scan() bool {
+	if ls.err != nil {
+		return false
+	}
+
+	text, err := ls.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		ls.err = fmt.Errorf("reading line %d: %w", ls.lineNo+1, err)
+		return false
+	}
+
+	if text == "" {
+		// |io.EOF| with no more data.
+		ls.err = io.EOF
+		return false
+	}
+
+	ls.lineNo++
+	ls.start = ls.offset
+	ls.offset += int64(len(text))
+
+	text = strings.TrimSuffix(text, "\n")
+	ls.text = strings.TrimSuffix(text, "\r")
+	return true
+}
+
+// Line returns the 1-based number, the starting byte offset and the content of the current line.
+func (ls *LineScanner) Line() (lineNo int, startOffset int64, text string) {
+	return ls.lineNo, ls.start, ls.text
+}
+
+// Err returns the first non-EOF error found while scanning.
+func (ls *LineScanner) Err() error {
+	if ls.err == io.EOF {
+		return nil
+	}
+
+	return ls.err
+}
@@ -0,0 +1,86 @@
+package files
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Hardlink creates |newpath| as a hard link to |oldpath|.
+func Hardlink(oldpath, newpath string) error {
+	return HardlinkAdvanced(oldpath, newpath, nil)
+}
+
+// Symlink creates |newpath| as a symbolic link pointing to |oldpath|.
+//
+// NOTE: On Windows, creating symlinks requires either administrator privileges or Developer Mode
+// to be enabled. Otherwise this will fail with a "A required privilege is not held by the client"
+// error. Consider |Hardlink| or |CopyFile| as fallbacks there.
+func Symlink(oldpath, newpath string) error {
+	return SymlinkAdvanced(oldpath, newpath, nil)
+}
+
+type LinkAdvancedOptions struct {
+	// CreateDir determines whether to try to create the owning directory of |newpath|.
+	CreateDir         bool
+	CreateDirFileMode fs.FileMode
+
+	// Force removes any existing file at |newpath| before creating the link.
+	Force bool
+}
+
+var (
+	GDefaultLinkAdvancedOptions = LinkAdvancedOptions{
+		CreateDir:         false,
+		CreateDirFileMode: 0755,
+		Force:             false,
+	}
+)
+
+// HardlinkAdvanced is like |Hardlink| but permits to create the parent dir and to overwrite an
+// already existing |newpath|.
+func HardlinkAdvanced(oldpath, newpath string, options *LinkAdvancedOptions) error {
+	if err := prepareLink(newpath, options); err != nil {
+		return err
+	}
+
+	if err := os.Link(oldpath, newpath); err != nil {
+		return fmt.Errorf("hardlinking %q -> %q: %w", newpath, oldpath, err)
+	}
+
+	return nil
+}
+
+// SymlinkAdvanced is like |Symlink| but permits to create the parent dir and to overwrite an
+// already existing |newpath|. See |Symlink| for caveats on Windows.
+func SymlinkAdvanced(oldpath, newpath string, options *LinkAdvancedOptions) error {
+	if err := prepareLink(newpath, options); err != nil {
+		return err
+	}
+
+	if err := os.Symlink(oldpath, newpath); err != nil {
+		return fmt.Errorf("symlinking %q -> %q: %w", newpath, oldpath, err)
+	}
+
+	return nil
+}
+
+func prepareLink(newpath string, options *LinkAdvancedOptions) error {
+	if options == nil {
+		options = &GDefaultLinkAdvancedOptions
+	}
+
+	if options.CreateDir {
+		if err := EnsureParentDir(newpath, options.CreateDirFileMode); err != nil {
+			return err
+		}
+	}
+
+	if options.Force {
+		if err := DeleteFile(newpath); err != nil {
+			return fmt.Errorf("removing existing %q: %w", newpath, err)
+		}
+	}
+
+	return nil
+}
@@ -3,20 +3,63 @@ package files
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 type LoadedFile struct {
-	Key   string
-	Data  []byte
+	Key string
+	// Data is the content of the file. If modified directly, |InvalidateLines| must be called
+	// afterwards, and the size accounting of the cache holding it (if any) is not updated. Prefer
+	// |SetData|.
+	Data []byte
+
+	// mu guards the lazily computed fields below (and |lazy|), as the same file is shared through
+	// the cache.
+	mu    sync.Mutex
 	lines []string
+	// lineStarts are the byte offsets at which each line starts. Lazily computed.
+	lineStarts []int
+
+	// lazy is set for files loaded with |LoadFileLazy|, whose content is not in |Data|.
+	lazy *lazyIndex
+	// decompressed is set for files loaded with |LoadFromPathDecompressed|, so that reloading them
+	// (see |FileCache.Watch|) gets the same kind of content.
+	decompressed bool
 
 	FromFile bool
 	Stat     fs.FileInfo
+	// path is where the file was loaded from, see |Path|.
+	path string
+
+	// owner is the cache holding this entry, if any, so that |SetData| can keep its size accounting
+	// up to date. Only changed while holding the lock of the cache.
+	owner atomic.Pointer[FileCache]
+}
+
+// NewLoadedFile creates a bare loaded file with the given key and data. Unlike |NewFromData|, this
+// does not go through any cache, so there are no key-collision checks nor caching side effects.
+func NewLoadedFile(key string, data []byte) *LoadedFile {
+	return &LoadedFile{
+		Key:  key,
+		Data: data,
+	}
 }
 
 // LoadedFilePosition represents a single position (character) within a loaded file.
+// |Line| and |Char| are 1-based.
 type LoadedFilePosition struct {
 	File *LoadedFile
 	Line int
@@ -31,18 +74,310 @@ func NewLoadedFilePosition(lf *LoadedFile, line, char int) *LoadedFilePosition {
 	}
 }
 
-// Path returns the Key as a path if the file was loaded from file rather than a buffer.
-// Returns empty otherwise.
+// String returns the position in the "path:line:char" form. If the file was not loaded from a path,
+// the key is used instead.
+func (pos LoadedFilePosition) String() string {
+	return fmt.Sprintf("%s:%d:%d", pos.filePath(), pos.Line, pos.Char)
+}
+
+// MarshalText returns the same as |String|.
+func (pos LoadedFilePosition) MarshalText() ([]byte, error) {
+	return []byte(pos.String()), nil
+}
+
+type loadedFilePositionJSON struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Char int    `json:"char"`
+}
+
+// MarshalJSON emits the position as {"path": ..., "line": ..., "char": ...}, without the content of
+// the file.
+func (pos LoadedFilePosition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(loadedFilePositionJSON{
+		Path: pos.filePath(),
+		Line: pos.Line,
+		Char: pos.Char,
+	})
+}
+
+// UnmarshalJSON reads the format emitted by |MarshalJSON|. The file is looked up in the global
+// cache by the path. If it's not there, |File| is set to a data-less placeholder keyed by the path.
+func (pos *LoadedFilePosition) UnmarshalJSON(data []byte) error {
+	var pj loadedFilePositionJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return fmt.Errorf("unmarshalling position: %w", err)
+	}
+
+	pos.Line = pj.Line
+	pos.Char = pj.Char
+	pos.File = nil
+	if pj.Path == "" {
+		return nil
+	}
+
+	if found, lf := QueryKey(pj.Path); found {
+		pos.File = lf
+	} else {
+		pos.File = NewLoadedFile(pj.Path, nil)
+	}
+
+	return nil
+}
+
+func (pos LoadedFilePosition) filePath() string {
+	if pos.File == nil {
+		return ""
+	}
+
+	if path := pos.File.Path(); path != "" {
+		return path
+	}
+
+	return pos.File.Key
+}
+
+// Snippet renders the line of the position with a caret under the character, eg:
+//
+//	12 | foo := bar(baz)
+//	   |        ^
+//
+// Tabs are expanded (see |DisplayColumn|) so that the caret is aligned.
+func (pos LoadedFilePosition) Snippet() (string, error) {
+	if pos.File == nil {
+		return "", fmt.Errorf("position %s has no file", pos)
+	}
+
+	const tabWidth = 8
+	col, err := pos.File.DisplayColumn(pos.Line, pos.Char-1, tabWidth)
+	if err != nil {
+		return "", fmt.Errorf("snippet for %s: %w", pos, err)
+	}
+
+	text, err := pos.File.line(pos.Line)
+	if err != nil {
+		return "", err
+	}
+
+	var expanded strings.Builder
+	width := 0
+	for _, r := range text {
+		if r == '\t' {
+			spaces := tabWidth - (width % tabWidth)
+			expanded.WriteString(strings.Repeat(" ", spaces))
+			width += spaces
+		} else {
+			expanded.WriteRune(r)
+			width++
+		}
+	}
+
+	gutter := strconv.Itoa(pos.Line)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s | %s\n", gutter, expanded.String())
+	fmt.Fprintf(&sb, "%s | %s^", strings.Repeat(" ", len(gutter)), strings.Repeat(" ", col))
+	return sb.String(), nil
+}
+
+// LoadedFileRange represents a range of whole lines within a loaded file.
+// |StartLine| and |EndLine| are 1-based and inclusive. An empty range has |EndLine| equal to
+// |StartLine| - 1.
+type LoadedFileRange struct {
+	File      *LoadedFile
+	StartLine int
+	EndLine   int
+}
+
+// Lines returns the lines within the range.
+func (r *LoadedFileRange) Lines() ([]string, error) {
+	lines, err := r.File.Lines()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.StartLine < 1 || r.EndLine < r.StartLine-1 || r.EndLine > len(lines) {
+		return nil, fmt.Errorf("invalid line range [%d, %d] (file has %d lines)", r.StartLine, r.EndLine, len(lines))
+	}
+
+	return lines[r.StartLine-1 : r.EndLine], nil
+}
+
+// Sections splits the file into the ranges between lines equal to |delimiter| (eg. "---"), which
+// are not included in any range. N delimiters always produce N+1 (possibly empty) ranges. Since
+// ranges refer to the original file, positions within each section remain accurate.
+func (lf *LoadedFile) Sections(delimiter string) ([]LoadedFileRange, error) {
+	lines, err := lf.Lines()
+	if err != nil {
+		return nil, err
+	}
+
+	var sections []LoadedFileRange
+	start := 1
+	for i, line := range lines {
+		if line != delimiter {
+			continue
+		}
+
+		sections = append(sections, LoadedFileRange{File: lf, StartLine: start, EndLine: i})
+		start = i + 2
+	}
+	sections = append(sections, LoadedFileRange{File: lf, StartLine: start, EndLine: len(lines)})
+
+	return sections, nil
+}
+
+// Path returns the absolute path the file was loaded from (fully resolved if the cache uses
+// canonical keys, see |FileCache.SetCanonicalKeys|) if it was loaded from file rather than a buffer.
+// Unlike the key, this is always a path that can be used to access the file. Returns empty
+// otherwise.
 func (lf *LoadedFile) Path() string {
-	if lf.FromFile {
+	if !lf.FromFile {
+		return ""
+	}
+
+	// Files marked as from-file by the user have no recorded path, but their key is one.
+	if lf.path == "" {
 		return lf.Key
 	}
 
-	return ""
+	return lf.path
+}
+
+// IsStale checks whether the file on disk changed since it was loaded, by comparing the modification
+// time and size against |Stat|. A file that no longer exists is considered stale, as is a from-file
+// entry without a |Stat| to compare against.
+// In-memory files are never stale.
+func (lf *LoadedFile) IsStale() (bool, error) {
+	if !lf.FromFile {
+		return false, nil
+	}
+
+	if lf.Stat == nil {
+		return true, nil
+	}
+
+	stat, found, err := StatFile(lf.Path())
+	if err != nil {
+		return false, fmt.Errorf("statting %q: %w", lf.Path(), err)
+	}
+
+	if !found {
+		return true, nil
+	}
+
+	if !stat.ModTime().Equal(lf.Stat.ModTime()) || stat.Size() != lf.Stat.Size() {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// ContentType returns the MIME type of the file.
+// The content is sniffed first (see |http.DetectContentType|). If that is inconclusive (ie. it
+// returns "application/octet-stream"), we fallback to detection based on the extension of |Path|.
+// If that also fails, "application/octet-stream" is returned.
+func (lf *LoadedFile) ContentType() string {
+	const unknown = "application/octet-stream"
+
+	data := lf.Data
+	if len(data) > 512 {
+		data = data[:512]
+	}
+
+	if ct := http.DetectContentType(data); ct != unknown {
+		return ct
+	}
+
+	if ext := filepath.Ext(lf.Path()); ext != "" {
+		if ct := mime.TypeByExtension(ext); ct != "" {
+			return ct
+		}
+	}
+
+	return unknown
+}
+
+// WithReplaced returns a new loaded file with all the matches of |re| in |Data| replaced by |repl|
+// (see |regexp.Regexp.ReplaceAll| for the expansion rules). The original file is not modified.
+// The new file keeps the same |Key| and |FromFile|, so |Path| still refers to where the content
+// came from, but it is NOT inserted in any cache. Since the content no longer reflects the file on
+// disk, |Stat| is not carried over.
+func (lf *LoadedFile) WithReplaced(re *regexp.Regexp, repl string) *LoadedFile {
+	replaced := NewLoadedFile(lf.Key, re.ReplaceAll(lf.Data, []byte(repl)))
+	replaced.FromFile = lf.FromFile
+	replaced.path = lf.path
+	return replaced
 }
 
-// Lines lazily parses the content of the file into lines.
+// SetData replaces the content of the file, invalidating any memoized data derived from it. It is
+// safe to call concurrently with the line accessors (eg. |Lines|, |LineStarts| or |Line|), but not
+// with direct accesses to |Data|.
+// If the file is in a cache, its size accounting is updated (see |FileCache.SetLimits|), which could
+// evict entries (this one included).
+func (lf *LoadedFile) SetData(data []byte) {
+	for {
+		fc := lf.owner.Load()
+		if fc == nil {
+			lf.setData(data)
+			return
+		}
+
+		// The cache reads |Data| while holding its lock, so we need it too.
+		fc.mu.Lock()
+		if lf.owner.Load() != fc {
+			// The entry was removed from the cache in the meantime.
+			fc.mu.Unlock()
+			continue
+		}
+
+		previous := lf.setData(data)
+		fc.totalBytes += int64(len(data) - previous)
+		fc.evictLocked()
+		fc.mu.Unlock()
+		return
+	}
+}
+
+// setData replaces the content of the file, returning the previous size of |Data|.
+func (lf *LoadedFile) setData(data []byte) int {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	previous := len(lf.Data)
+	lf.Data = data
+	lf.lazy = nil
+	lf.lines = nil
+	lf.lineStarts = nil
+	return previous
+}
+
+// InvalidateLines drops the memoized lines (and line offsets), so that they are computed again from
+// |Data| on the next call. This is needed after mutating |Data| directly.
+func (lf *LoadedFile) InvalidateLines() {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	lf.lines = nil
+
+	// Lazy files have no |Data| to recompute the offsets from.
+	if lf.lazy == nil {
+		lf.lineStarts = nil
+	}
+}
+
+// Lines lazily parses the content of the file into lines. It is safe to call concurrently.
+// The line terminators ("\n" or "\r\n") are not included, and a final newline does NOT produce a
+// trailing empty line (ie. "a\nb\n" and "a\nb" both yield ["a", "b"]). Use |HasFinalNewline| to
+// tell them apart.
+// Fails with |ErrLazyFile| for lazily loaded files, see |Line|.
 func (lf *LoadedFile) Lines() ([]string, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.lazy != nil {
+		return nil, fmt.Errorf("lines of %q: %w", lf.Key, ErrLazyFile)
+	}
+
 	// Check if the lines have already been loaded.
 	if lf.lines != nil {
 		return lf.lines, nil
@@ -62,3 +397,308 @@ func (lf *LoadedFile) Lines() ([]string, error) {
 	lf.lines = lines
 	return lf.lines, nil
 }
+
+// LineMap returns the lines keyed by their 1-based line number. Unlike |Lines|, the result is not
+// memoized, so callers are free to modify it (eg. deleting the lines they don't care about).
+func (lf *LoadedFile) LineMap() (map[int]string, error) {
+	lines, err := lf.Lines()
+	if err != nil {
+		return nil, err
+	}
+
+	lineMap := make(map[int]string, len(lines))
+	for i, line := range lines {
+		lineMap[i+1] = line
+	}
+
+	return lineMap, nil
+}
+
+// Split tokenizes |Data| by |sep| (eg. 0 for `find -print0` output). As with |Lines|, a trailing
+// separator does not produce a final empty token. Unlike |Lines|, the result is not memoized.
+func (lf *LoadedFile) Split(sep byte) ([]string, error) {
+	return lf.SplitFunc(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+
+		if atEOF {
+			return len(data), data, nil
+		}
+
+		// Request more data.
+		return 0, nil, nil
+	})
+}
+
+// SplitFunc tokenizes |Data| with an arbitrary |bufio.SplitFunc|. The result is not memoized.
+func (lf *LoadedFile) SplitFunc(split bufio.SplitFunc) ([]string, error) {
+	lf.mu.Lock()
+	lazy, data := lf.lazy, lf.Data
+	lf.mu.Unlock()
+
+	if lazy != nil {
+		return nil, fmt.Errorf("splitting %q: %w", lf.Key, ErrLazyFile)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// A single token could span the whole data.
+	scanner.Buffer(make([]byte, 0, 4096), len(data)+1)
+	scanner.Split(split)
+
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("splitting file: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// LineOptions determines how |LinesFiltered| processes the lines.
+type LineOptions struct {
+	// TrimTrailingSpace removes the trailing whitespace of each line.
+	TrimTrailingSpace bool
+	// SkipBlank skips lines that are empty or only whitespace.
+	SkipBlank bool
+	// SkipPrefix skips lines that start with it, ignoring leading whitespace. Useful for comments.
+	SkipPrefix string
+	// StripBOM removes a leading UTF-8 byte-order mark from the first line, so that it does not
+	// carry invisible bytes. See |HasBOM|.
+	StripBOM bool
+}
+
+// LinesFiltered is like |Lines|, but post-processes the lines according to |opts|.
+// See |LinesFilteredIndexed| for also obtaining the original line numbers.
+func (lf *LoadedFile) LinesFiltered(opts LineOptions) ([]string, error) {
+	lines, _, err := lf.LinesFilteredIndexed(opts)
+	return lines, err
+}
+
+// LinesFilteredIndexed is like |LinesFiltered|, but also returns a parallel slice with the 1-based
+// line number (within the file) of each of the returned lines.
+func (lf *LoadedFile) LinesFilteredIndexed(opts LineOptions) ([]string, []int, error) {
+	lines, err := lf.Lines()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result []string
+	var indices []int
+	for i, line := range lines {
+		if opts.StripBOM && i == 0 {
+			line = strings.TrimPrefix(line, string(bomUTF8))
+		}
+
+		if opts.TrimTrailingSpace {
+			line = strings.TrimRightFunc(line, unicode.IsSpace)
+		}
+
+		if opts.SkipBlank && strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if opts.SkipPrefix != "" && strings.HasPrefix(strings.TrimLeftFunc(line, unicode.IsSpace), opts.SkipPrefix) {
+			continue
+		}
+
+		result = append(result, line)
+		indices = append(indices, i+1)
+	}
+
+	return result, indices, nil
+}
+
+// HasFinalNewline returns whether the data ends with a newline character.
+func (lf *LoadedFile) HasFinalNewline() bool {
+	return len(lf.Data) > 0 && lf.Data[len(lf.Data)-1] == '\n'
+}
+
+// DisplayColumn returns the visual (0-based) column of the rune at |charIndex| (0-based) within the
+// 1-based |line|. Tabs advance to the next multiple of |tabWidth|, which defaults to 8 if not
+// positive. |charIndex| can be equal to the amount of runes in the line, which refers to the column
+// just after the end of it.
+func (lf *LoadedFile) DisplayColumn(line, charIndex, tabWidth int) (int, error) {
+	if tabWidth <= 0 {
+		tabWidth = 8
+	}
+
+	text, err := lf.line(line)
+	if err != nil {
+		return 0, err
+	}
+
+	if charIndex < 0 {
+		return 0, fmt.Errorf("invalid char index %d", charIndex)
+	}
+
+	col := 0
+	index := 0
+	for _, r := range text {
+		if index == charIndex {
+			return col, nil
+		}
+
+		if r == '\t' {
+			col += tabWidth - (col % tabWidth)
+		} else {
+			col++
+		}
+		index++
+	}
+
+	if index == charIndex {
+		return col, nil
+	}
+
+	return 0, fmt.Errorf("char index %d out of range for line %d (%d chars)", charIndex, line, index)
+}
+
+// LineRuneCount returns the amount of runes in the 1-based line |n|.
+func (lf *LoadedFile) LineRuneCount(n int) (int, error) {
+	line, err := lf.line(n)
+	if err != nil {
+		return 0, err
+	}
+
+	return utf8.RuneCountInString(line), nil
+}
+
+// LineByteLen returns the amount of bytes in the 1-based line |n|, not counting the terminator.
+func (lf *LoadedFile) LineByteLen(n int) (int, error) {
+	line, err := lf.line(n)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(line), nil
+}
+
+// SubstringByteRange returns a copy of the bytes of |Data| in [start, end). A copy is returned
+// because |Data| is shared by all the holders of a cached file, so it must not be mutated.
+func (lf *LoadedFile) SubstringByteRange(start, end int) ([]byte, error) {
+	lf.mu.Lock()
+	lazy, data := lf.lazy, lf.Data
+	lf.mu.Unlock()
+
+	size := len(data)
+	if lazy != nil {
+		size = lazy.size
+	}
+
+	if start < 0 || start > end || end > size {
+		return nil, fmt.Errorf("invalid byte range [%d, %d) for %d bytes", start, end, size)
+	}
+
+	if lazy != nil {
+		return ReadFileRange(lazy.path, int64(start), int64(end-start))
+	}
+
+	return bytes.Clone(data[start:end]), nil
+}
+
+// LineAtOffset returns the 1-based line that contains |byteOffset|. An offset equal to the length of
+// the data (ie. the end of the file) is valid and refers to the last line. For an empty file, only
+// offset 0 is valid and it refers to line 1.
+// The line starts are computed on the first call, so subsequent lookups are O(log n).
+func (lf *LoadedFile) LineAtOffset(byteOffset int) (int, error) {
+	if byteOffset < 0 || byteOffset > lf.dataLen() {
+		return 0, fmt.Errorf("offset %d out of range [0, %d]", byteOffset, lf.dataLen())
+	}
+
+	starts := lf.LineStarts()
+
+	// We want the last line that starts at or before the offset.
+	index := sort.Search(len(starts), func(i int) bool {
+		return starts[i] > byteOffset
+	})
+
+	return index, nil
+}
+
+// LineRangeForByteSpan returns the 1-based (inclusive) range of lines touched by the byte span
+// [start, end). A span ending exactly at the start of a line (ie. right after a newline) does not
+// include that line. An empty span refers to the line containing |start|.
+func (lf *LoadedFile) LineRangeForByteSpan(start, end int) (startLine, endLine int, err error) {
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid byte span [%d, %d)", start, end)
+	}
+
+	startLine, err = lf.LineAtOffset(start)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start == end {
+		return startLine, startLine, nil
+	}
+
+	// |end| is exclusive, so the last touched byte is the one before it.
+	if end > lf.dataLen() {
+		return 0, 0, fmt.Errorf("offset %d out of range [0, %d]", end, lf.dataLen())
+	}
+
+	endLine, err = lf.LineAtOffset(end - 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return startLine, endLine, nil
+}
+
+// LineStarts returns the byte offsets at which each line starts, so index 0 is always 0. A final
+// newline does not start a new line, consistent with |Lines|.
+// The slice is lazily computed and memoized, so it must not be modified.
+func (lf *LoadedFile) LineStarts() []int {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.lineStarts != nil {
+		return lf.lineStarts
+	}
+
+	starts := []int{0}
+	for i, b := range lf.Data {
+		if b == '\n' && i+1 < len(lf.Data) {
+			starts = append(starts, i+1)
+		}
+	}
+
+	lf.lineStarts = starts
+	return lf.lineStarts
+}
+
+// Line returns the content of the 1-based line |n|. Unlike |Lines|, this also works for lazily
+// loaded files (see |LoadFileLazy|), where only that line is read from disk.
+func (lf *LoadedFile) Line(n int) (string, error) {
+	return lf.line(n)
+}
+
+// line returns the content of the given 1-based line.
+func (lf *LoadedFile) line(n int) (string, error) {
+	lf.mu.Lock()
+	lazy, starts := lf.lazy, lf.lineStarts
+	lf.mu.Unlock()
+
+	if lazy != nil {
+		return lazy.line(starts, n)
+	}
+
+	lines, err := lf.Lines()
+	if err != nil {
+		return "", err
+	}
+
+	if n < 1 || n > len(lines) {
+		return "", fmt.Errorf("line %d out of range (file has %d lines)", n, len(lines))
+	}
+
+	return lines[n-1], nil
+}
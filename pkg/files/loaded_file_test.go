@@ -0,0 +1,78 @@
+package files
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestLinesConcurrent(t *testing.T) {
+	lf := NewLoadedFile("file.txt", []byte("first\nsecond\n\nfourth"))
+	wantLines := []string{"first", "second", "", "fourth"}
+	wantStarts := []int{0, 6, 13, 14}
+
+	const goroutines = 64
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			lines, err := lf.Lines()
+			if err != nil {
+				t.Errorf("Lines(): %v", err)
+				return
+			}
+			if !reflect.DeepEqual(lines, wantLines) {
+				t.Errorf("Lines() = %q, want %q", lines, wantLines)
+			}
+
+			if starts := lf.LineStarts(); !reflect.DeepEqual(starts, wantStarts) {
+				t.Errorf("LineStarts() = %v, want %v", starts, wantStarts)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestSetDataConcurrentWithLines(t *testing.T) {
+	lf := NewLoadedFile("file.txt", []byte("a\nb\n"))
+	contents := [][]byte{[]byte("a\nb\n"), []byte("c\nd\ne\n")}
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			for j := 0; j < 100; j++ {
+				if i%2 == 0 {
+					lf.SetData(contents[j%2])
+					continue
+				}
+
+				// Each call sees one of the versions, never a mix of them.
+				lines, err := lf.Lines()
+				if err != nil {
+					t.Errorf("Lines(): %v", err)
+					return
+				}
+				if len(lines) != 2 && len(lines) != 3 {
+					t.Errorf("Lines() = %q, want the lines of one of the versions", lines)
+				}
+
+				lf.LineStarts()
+				if _, err := lf.Line(1); err != nil {
+					t.Errorf("Line(1): %v", err)
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+package files
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LoaderHook transforms the data of a file as it is loaded into a |FileCache|. Hooks must be pure:
+// the output should only depend on |data|, as the result is cached.
+type LoaderHook func(data []byte) ([]byte, error)
+
+var (
+	gLoaderHooksMu sync.RWMutex
+	gLoaderHooks   = map[string][]LoaderHook{}
+)
+
+// RegisterLoaderHook registers |hook| to post-process the data of the files with extension |ext|
+// (eg. ".json", the leading dot is optional and the match is case-insensitive) loaded from disk
+// into any |FileCache| (or through |LoadFileUncached|). Several hooks for the same extension run
+// in registration order. For decompressed files (see |LoadFileFromPathDecompressed|) the extension
+// before ".gz" is used.
+//
+// Hooks are meant to be registered at init time, as files already in the cache are not affected.
+func RegisterLoaderHook(ext string, hook func(data []byte) ([]byte, error)) {
+	ext = normalizeHookExt(ext)
+
+	gLoaderHooksMu.Lock()
+	defer gLoaderHooksMu.Unlock()
+	gLoaderHooks[ext] = append(gLoaderHooks[ext], hook)
+}
+
+func normalizeHookExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// applyLoaderHooks runs the hooks registered for the extension of |path| over |data|.
+func applyLoaderHooks(path string, gunzip bool, data []byte) ([]byte, error) {
+	if gunzip {
+		path = strings.TrimSuffix(path, ".gz")
+	}
+
+	ext := filepath.Ext(path)
+	if ext == "" {
+		return data, nil
+	}
+	ext = normalizeHookExt(ext)
+
+	gLoaderHooksMu.RLock()
+	hooks := gLoaderHooks[ext]
+	gLoaderHooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		var err error
+		data, err = hook(data)
+		if err != nil {
+			return nil, fmt.Errorf("running %q loader hook on %q: %w", ext, path, err)
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,35 @@
+package files
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ExtendedLengthPath returns the Windows extended-length form of |path| (eg. `\\?\C:\foo` or
+// `\\?\UNC\server\share\foo`), which is not subject to the MAX_PATH (260 chars) limit.
+// Only absolute paths are converted, relative or already prefixed paths are returned unchanged.
+// On other platforms this is a no-op.
+func ExtendedLengthPath(path string) string {
+	return extendedLengthPath(path)
+}
+
+func toExtendedLengthPath(path string) string {
+	const prefix = `\\?\`
+
+	path = strings.ReplaceAll(path, "/", `\`)
+	if strings.HasPrefix(path, prefix) {
+		return path
+	}
+
+	// UNC path: \\server\share\...
+	if strings.HasPrefix(path, `\\`) {
+		return prefix + `UNC\` + strings.TrimPrefix(filepath.Clean(path), `\\`)
+	}
+
+	// Drive absolute path: C:\...
+	if len(path) >= 3 && path[1] == ':' && path[2] == '\\' {
+		return prefix + filepath.Clean(path)
+	}
+
+	return path
+}
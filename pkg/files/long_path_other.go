@@ -0,0 +1,7 @@
+//go:build !windows
+
+package files
+
+func extendedLengthPath(path string) string {
+	return path
+}
@@ -0,0 +1,83 @@
+package files
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// ManifestResult holds the differences between a directory tree and a manifest, as returned by
+// |VerifyManifest|. All the paths are relative Unix paths, sorted lexically.
+type ManifestResult struct {
+	// Missing are the files in the manifest that are not in the tree.
+	Missing []string
+	// Extra are the files in the tree that are not in the manifest.
+	Extra []string
+	// Mismatched are the files whose hash differs from the manifest.
+	Mismatched []string
+}
+
+// OK returns whether the tree matched the manifest exactly.
+func (mr *ManifestResult) OK() bool {
+	return len(mr.Missing) == 0 && len(mr.Extra) == 0 && len(mr.Mismatched) == 0
+}
+
+// VerifyManifest checks the files under |root| against |manifest|, which maps relative Unix paths
+// to the hex encoded sha256 of their content (see |HashFile|). The files are hashed concurrently.
+// The manifest paths are normalized (see |ToUnixPath|) and the hashes compared case-insensitively.
+func VerifyManifest(root string, manifest map[string]string) (*ManifestResult, error) {
+	expected := make(map[string]string, len(manifest))
+	for key, hash := range manifest {
+		expected[path.Clean(ToUnixPath(key))] = strings.ToLower(hash)
+	}
+
+	entries, err := ListFilesRecursive(root)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ManifestResult{}
+	var common []string
+	inTree := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		inTree[entry] = true
+		if _, ok := expected[entry]; ok {
+			common = append(common, entry)
+		} else {
+			result.Extra = append(result.Extra, entry)
+		}
+	}
+
+	for key := range expected {
+		if !inTree[key] {
+			result.Missing = append(result.Missing, key)
+		}
+	}
+	sort.Strings(result.Missing)
+
+	type hashResult struct {
+		hash string
+		err  error
+	}
+	results := make([]hashResult, len(common))
+
+	parallelFor(len(common), runtime.NumCPU(), func(index int) {
+		hash, err := HashFile(filepath.Join(root, filepath.FromSlash(common[index])))
+		results[index] = hashResult{hash: hash, err: err}
+	})
+
+	for i, entry := range common {
+		if results[i].err != nil {
+			return nil, fmt.Errorf("verifying %q: %w", entry, results[i].err)
+		}
+
+		if results[i].hash != expected[entry] {
+			result.Mismatched = append(result.Mismatched, entry)
+		}
+	}
+
+	return result, nil
+}
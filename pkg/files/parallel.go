@@ -0,0 +1,33 @@
+package files
+
+import (
+	"runtime"
+	"sync"
+)
+
+// parallelFor calls |fn| for every index in [0, n) using |workers| goroutines, and waits for all of
+// them to finish. If |workers| is not positive, |runtime.NumCPU| is used. |fn| is expected to store
+// its results by index, so that callers can process them in order afterwards.
+func parallelFor(n, workers int, fn func(i int)) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				fn(index)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
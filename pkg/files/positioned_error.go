@@ -0,0 +1,28 @@
+package files
+
+import "fmt"
+
+// PositionedError is an error that refers to a position within a loaded file, such as a diagnostic
+// emitted by a parser or a linter.
+type PositionedError struct {
+	Pos LoadedFilePosition
+	Msg string
+}
+
+// Errorf creates a |PositionedError| at |pos|, formatting the message as |fmt.Sprintf|.
+func Errorf(pos LoadedFilePosition, format string, args ...any) *PositionedError {
+	return &PositionedError{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+// Error returns the error in the "path:line:char: msg" form.
+func (e *PositionedError) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// Snippet renders the line the error refers to. See |LoadedFilePosition.Snippet|.
+func (e *PositionedError) Snippet() (string, error) {
+	return e.Pos.Snippet()
+}
@@ -0,0 +1,50 @@
+package files
+
+import "time"
+
+// WithRetry calls |op| up to |attempts| times while it fails with a transient error (see
+// |IsTransientError|), sleeping |backoff| before the first retry and doubling it after each one.
+// Any other error is returned right away. Returns the last error if all the attempts fail.
+func WithRetry(op func() error, attempts int, backoff time.Duration) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = op()
+		if err == nil || !IsTransientError(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// RetryOptions configures the retrying of filesystem operations that can transiently fail (see
+// |WithRetry|).
+type RetryOptions struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// retry calls |op| with |WithRetry| according to |options|, or just once if nil.
+func (options *RetryOptions) retry(op func() error) error {
+	if options == nil {
+		return op()
+	}
+
+	return WithRetry(op, options.Attempts, options.Backoff)
+}
+
+// IsTransientError returns whether |err| is known to be a transient failure of the filesystem, such
+// as a file being temporarily busy (or, on Windows, locked by another process like an antivirus).
+// Genuine failures (eg. the file not existing) are not transient.
+func IsTransientError(err error) bool {
+	return isTransientError(err)
+}
@@ -0,0 +1,79 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SplitFile splits the file at |path| into sequential |chunkSize| chunks written into |outDir|
+// (created if needed) as "part-000", "part-001", etc. The last chunk might be smaller. Returns the
+// paths of the parts in order. An empty file produces no parts. See |JoinFiles| for the inverse.
+func SplitFile(path string, chunkSize int64, outDir string) ([]string, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("splitting %q: invalid chunk size %d", path, chunkSize)
+	}
+
+	src, err := os.Open(extendedLengthPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(extendedLengthPath(outDir), 0755); err != nil {
+		return nil, fmt.Errorf("creating dir %q: %w", outDir, err)
+	}
+
+	var parts []string
+	for i := 0; ; i++ {
+		part := filepath.Join(outDir, fmt.Sprintf("part-%03d", i))
+		written, err := CopyReaderToFile(io.LimitReader(src, chunkSize), part, nil)
+		if err != nil {
+			return nil, fmt.Errorf("splitting %q: %w", path, err)
+		}
+
+		// We only know we reached the end once a read returns nothing.
+		if written == 0 {
+			if err := DeleteFile(part); err != nil {
+				return nil, fmt.Errorf("removing %q: %w", part, err)
+			}
+			break
+		}
+
+		parts = append(parts, part)
+		if written < chunkSize {
+			break
+		}
+	}
+
+	return parts, nil
+}
+
+// JoinFiles concatenates the content of |parts| (in order) into |dst|, which is created or
+// truncated. If it fails, |dst| is removed. This is the inverse of |SplitFile|.
+func JoinFiles(parts []string, dst string) (retErr error) {
+	out, err := os.Create(extendedLengthPath(dst))
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", dst, err)
+	}
+
+	defer func() {
+		if err := out.Close(); err != nil && retErr == nil {
+			retErr = fmt.Errorf("closing %q: %w", dst, err)
+		}
+
+		if retErr != nil {
+			// Best effort. We don't want to shadow the original error.
+			os.Remove(extendedLengthPath(dst))
+		}
+	}()
+
+	for _, part := range parts {
+		if _, err := CopyFileToWriter(part, out); err != nil {
+			return fmt.Errorf("joining into %q: %w", dst, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package files
+
+import (
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// statCacheSweepSize is the amount of entries over which |StatFileCached| removes the expired ones.
+const statCacheSweepSize = 1024
+
+type statCacheEntry struct {
+	info  fs.FileInfo
+	found bool
+	at    time.Time
+}
+
+var (
+	gStatCacheMu sync.Mutex
+	gStatCache   = map[string]*statCacheEntry{}
+)
+
+// StatFileCached is like |StatFile|, but reuses the result of a previous call for the same |path|
+// if it is not older than |ttl|. This trades a small staleness window for fewer syscalls in hot
+// loops (eg. polling). Errors are never cached.
+func StatFileCached(path string, ttl time.Duration) (fs.FileInfo, bool, error) {
+	now := time.Now()
+
+	gStatCacheMu.Lock()
+	entry, ok := gStatCache[path]
+	gStatCacheMu.Unlock()
+
+	if ok && now.Sub(entry.at) < ttl {
+		return entry.info, entry.found, nil
+	}
+
+	info, found, err := StatFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	gStatCacheMu.Lock()
+	defer gStatCacheMu.Unlock()
+
+	gStatCache[path] = &statCacheEntry{info: info, found: found, at: now}
+	if len(gStatCache) > statCacheSweepSize {
+		for key, entry := range gStatCache {
+			if now.Sub(entry.at) >= ttl {
+				delete(gStatCache, key)
+			}
+		}
+	}
+
+	return info, found, nil
+}
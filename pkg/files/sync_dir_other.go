@@ -0,0 +1,9 @@
+//go:build !unix
+
+package files
+
+// syncParentDir is a no-op outside Unix. On Windows directories cannot be opened for syncing and
+// NTFS already journals the rename metadata.
+func syncParentDir(path string) error {
+	return nil
+}
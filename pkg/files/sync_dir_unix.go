@@ -0,0 +1,26 @@
+//go:build unix
+
+package files
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// syncParentDir calls sync on the directory containing |path|, which is needed for some
+// filesystems to durably persist a rename (or creation) of |path|.
+func syncParentDir(path string) error {
+	dir := filepath.Dir(path)
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening dir %q: %w", dir, err)
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("calling sync on dir %q: %w", dir, err)
+	}
+
+	return nil
+}
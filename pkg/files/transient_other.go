@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package files
+
+func isTransientError(err error) bool {
+	return false
+}
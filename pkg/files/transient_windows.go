@@ -0,0 +1,21 @@
+//go:build windows
+
+package files
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+func isTransientError(err error) bool {
+	// Access denied is usually a genuine error, but on Windows it is also what renaming or removing a
+	// file that another process (eg. an antivirus) has open returns.
+	return errors.Is(err, errorSharingViolation) ||
+		errors.Is(err, errorLockViolation) ||
+		errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+}
@@ -0,0 +1,344 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WalkOptions controls how the walking helpers of this package traverse a directory tree.
+type WalkOptions struct {
+	// FollowSymlinks makes the walk go through symlinks, reporting the target of the link under the
+	// link's path. Symlinked directories are walked into.
+	// To protect against cycles, each directory is only walked once: directories are identified by
+	// device+inode on Unix and by their fully resolved path on other platforms. A directory that was
+	// already visited (eg. a link to an ancestor) is not reported nor walked again.
+	// Broken symlinks are reported as the link itself.
+	FollowSymlinks bool
+
+	// SkipHidden prunes any entry whose name starts with "." (eg. ".git"). For directories, the whole
+	// subtree is skipped.
+	SkipHidden bool
+
+	// Exclude prunes entries matching any of these patterns (see |path.Match|). A pattern is matched
+	// both against the relative Unix path and the base name of the entry. As with |SkipHidden|,
+	// excluding a directory skips its whole subtree.
+	Exclude []string
+}
+
+var (
+	GDefaultWalkOptions = WalkOptions{
+		FollowSymlinks: false,
+		SkipHidden:     false,
+		Exclude:        nil,
+	}
+)
+
+// excluded returns whether the entry at |rel| should be pruned from the walk.
+func (options *WalkOptions) excluded(rel string) bool {
+	name := path.Base(rel)
+	if options.SkipHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+
+	for _, pattern := range options.Exclude {
+		// The patterns are validated at the beginning of the walk.
+		if matched, _ := path.Match(pattern, rel); matched {
+			return true
+		}
+
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListFilesRecursive returns the paths of all the files (not directories) under |root|. The paths
+// are relative to |root|, use Unix separators and are sorted lexically.
+func ListFilesRecursive(root string) ([]string, error) {
+	return ListFilesRecursiveAdvanced(root, nil)
+}
+
+// ListFilesRecursiveAdvanced is like |ListFilesRecursive| but permits to control the walk.
+func ListFilesRecursiveAdvanced(root string, options *WalkOptions) ([]string, error) {
+	var files []string
+	err := walkRelativeAdvanced(root, options, func(rel string, d fs.DirEntry) error {
+		if d.IsDir() {
+			return nil
+		}
+
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// ListDirsRecursive returns the paths of all the directories under |root| (not including |root|
+// itself), with the same conventions as |ListFilesRecursive|. Useful for recreating a tree,
+// including its empty directories.
+func ListDirsRecursive(root string) ([]string, error) {
+	return ListDirsRecursiveAdvanced(root, nil)
+}
+
+// ListDirsRecursiveAdvanced is like |ListDirsRecursive| but permits to control the walk.
+func ListDirsRecursiveAdvanced(root string, options *WalkOptions) ([]string, error) {
+	var dirs []string
+	err := walkRelativeAdvanced(root, options, func(rel string, d fs.DirEntry) error {
+		if d.IsDir() {
+			dirs = append(dirs, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dirs, nil
+}
+
+// DirSize returns the sum of the sizes of all the files under |root|.
+func DirSize(root string, options *WalkOptions) (int64, error) {
+	var size int64
+	err := walkRelativeAdvanced(root, options, func(rel string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("getting info for %q: %w", rel, err)
+		}
+
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+type ReadDirOptions struct {
+	// FilesOnly only returns entries that are not directories.
+	FilesOnly bool
+	// DirsOnly only returns directories.
+	DirsOnly bool
+	// Suffix only returns entries whose name ends with it (eg. ".go").
+	Suffix string
+	// Recursive also returns the entries of all subdirectories. In this case, the |Name| of the
+	// returned entries is the Unix-style path relative to the read directory.
+	Recursive bool
+}
+
+// ReadDirFiltered is like |os.ReadDir| (so the entries are sorted), but filters the entries
+// according to |opts|.
+func ReadDirFiltered(path string, opts ReadDirOptions) ([]fs.DirEntry, error) {
+	if opts.FilesOnly && opts.DirsOnly {
+		return nil, fmt.Errorf("FilesOnly and DirsOnly are mutually exclusive")
+	}
+
+	keep := func(name string, d fs.DirEntry) bool {
+		if opts.FilesOnly && d.IsDir() {
+			return false
+		}
+
+		if opts.DirsOnly && !d.IsDir() {
+			return false
+		}
+
+		return strings.HasSuffix(name, opts.Suffix)
+	}
+
+	if !opts.Recursive {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading dir %q: %w", path, err)
+		}
+
+		result := make([]fs.DirEntry, 0, len(entries))
+		for _, entry := range entries {
+			if keep(entry.Name(), entry) {
+				result = append(result, entry)
+			}
+		}
+
+		return result, nil
+	}
+
+	var result []fs.DirEntry
+	err := walkRelative(path, func(rel string, d fs.DirEntry) error {
+		if keep(d.Name(), d) {
+			result = append(result, &relativeDirEntry{DirEntry: d, rel: rel})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// relativeDirEntry is a |fs.DirEntry| whose name is the path relative to the walked root.
+type relativeDirEntry struct {
+	fs.DirEntry
+	rel string
+}
+
+func (e *relativeDirEntry) Name() string {
+	return e.rel
+}
+
+// walkRelative walks |root| in lexical order calling |fn| with the Unix-style path relative to
+// |root| for each entry. The root itself is not reported. |fn| can return |fs.SkipDir| to skip a
+// directory, as with |filepath.WalkDir|.
+func walkRelative(root string, fn func(rel string, d fs.DirEntry) error) error {
+	return walkRelativeAdvanced(root, nil, fn)
+}
+
+// walkRelativeAdvanced is like |walkRelative| but follows |options|.
+func walkRelativeAdvanced(root string, options *WalkOptions, fn func(rel string, d fs.DirEntry) error) error {
+	if options == nil {
+		options = &GDefaultWalkOptions
+	}
+
+	for _, pattern := range options.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+
+	// We prune the excluded entries before they reach |fn|.
+	userFn := fn
+	fn = func(rel string, d fs.DirEntry) error {
+		if options.excluded(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		return userFn(rel, d)
+	}
+
+	root = filepath.Clean(root)
+	walkRoot := extendedLengthPath(root)
+
+	if options.FollowSymlinks {
+		visited := map[any]bool{}
+		if err := walkFollowingSymlinks(walkRoot, "", visited, fn); err != nil {
+			return fmt.Errorf("walking %q: %w", root, err)
+		}
+
+		return nil
+	}
+
+	err := filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == walkRoot {
+			return nil
+		}
+
+		rel, err := RelUnix(walkRoot, path)
+		if err != nil {
+			return err
+		}
+		return fn(rel, d)
+	})
+
+	if err != nil {
+		return fmt.Errorf("walking %q: %w", root, err)
+	}
+
+	return nil
+}
+
+// walkFollowingSymlinks walks |dir| (whose path relative to the root is |rel|) resolving symlinks.
+// |visited| tracks the directories already walked to avoid cycles.
+func walkFollowingSymlinks(dir, rel string, visited map[any]bool, fn func(rel string, d fs.DirEntry) error) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	id, err := fileID(dir, info)
+	if err != nil {
+		return err
+	}
+
+	if visited[id] {
+		return nil
+	}
+	visited[id] = true
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		entryRel := entry.Name()
+		if rel != "" {
+			entryRel = rel + "/" + entry.Name()
+		}
+
+		d := entry
+		if entry.Type()&fs.ModeSymlink != 0 {
+			// Broken links are reported as themselves.
+			if target, err := os.Stat(path); err == nil {
+				d = fs.FileInfoToDirEntry(target)
+			}
+		}
+
+		if !d.IsDir() {
+			if err := fn(entryRel, d); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// We check for cycles before reporting the directory, so that it's reported only once.
+		dirInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		dirID, err := fileID(path, dirInfo)
+		if err != nil {
+			return err
+		}
+
+		if visited[dirID] {
+			continue
+		}
+
+		if err := fn(entryRel, d); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				continue
+			}
+			return err
+		}
+
+		if err := walkFollowingSymlinks(path, entryRel, visited, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchResyncInterval is how often |FileCache.Watch| picks up entries added to (or removed from)
+// the cache after the watch started.
+var watchResyncInterval = time.Second
+
+// Watch watches the directories of all the from-file entries of the cache and, whenever one of
+// those files changes on disk, reloads its entry and emits its key on the returned channel. Files
+// removed from disk are removed from the cache (their key is still emitted). Entries added to the
+// cache after the call are picked up periodically.
+//
+// Change detection is based on |IsStale|, so redundant filesystem events for the same change are
+// coalesced. Entries are reloaded the same way they were loaded (eg. entries loaded with
+// |LoadFromPathDecompressed| are decompressed again).
+//
+// The watch stops when |ctx| is cancelled, after which the channel is closed. Callers must keep
+// draining the channel until then.
+func (fc *FileCache) Watch(ctx context.Context) (<-chan string, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating watcher: %w", err)
+	}
+
+	w := &cacheWatcher{
+		fc:      fc,
+		watcher: watcher,
+		dirs:    map[string]bool{},
+		keys:    map[string]string{},
+	}
+
+	if err := w.resync(); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	ch := make(chan string, 16)
+	go w.run(ctx, ch)
+	return ch, nil
+}
+
+type cacheWatcher struct {
+	fc      *FileCache
+	watcher *fsnotify.Watcher
+
+	// dirs are the directories currently being watched.
+	dirs map[string]bool
+	// keys maps each watched file to its cache key. Files are identified by the key their path would
+	// have (see |FileCache.KeyForPath|), so that the paths reported by the watcher, which could differ
+	// in case, match them.
+	keys map[string]string
+}
+
+func (w *cacheWatcher) run(ctx context.Context, ch chan<- string) {
+	defer close(ch)
+	defer w.watcher.Close()
+
+	ticker := time.NewTicker(watchResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.resync(); err != nil {
+				log.Printf("files: watching cache: %v", err)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("files: watching cache: %v", err)
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			key, changed := w.handle(event)
+			if !changed {
+				continue
+			}
+
+			select {
+			case ch <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// resync updates the watched directories to match the from-file entries currently in the cache.
+func (w *cacheWatcher) resync() error {
+	keys := map[string]string{}
+	dirs := map[string]bool{}
+	var keyErr error
+	w.fc.Range(func(key string, lf *LoadedFile) bool {
+		path := lf.Path()
+		if path == "" {
+			return true
+		}
+
+		pathKey, err := w.fc.KeyForPath(path)
+		if err != nil {
+			keyErr = err
+			return false
+		}
+
+		keys[pathKey] = key
+		dirs[filepath.Dir(path)] = true
+		return true
+	})
+	if keyErr != nil {
+		return keyErr
+	}
+
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+
+		if err := w.watcher.Add(dir); err != nil {
+			// The directory might be gone already. We will retry on the next resync.
+			if errors.Is(err, fs.ErrNotExist) {
+				delete(dirs, dir)
+				continue
+			}
+			return fmt.Errorf("watching %q: %w", dir, err)
+		}
+	}
+
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			// Best effort, the directory might not exist anymore.
+			w.watcher.Remove(dir)
+		}
+	}
+
+	w.dirs = dirs
+	w.keys = keys
+	return nil
+}
+
+// handle reloads the entry affected by |event|, if any. Returns the key of the entry and whether it
+// actually changed.
+func (w *cacheWatcher) handle(event fsnotify.Event) (string, bool) {
+	pathKey, err := w.fc.KeyForPath(event.Name)
+	if err != nil {
+		log.Printf("files: watching cache: %v", err)
+		return "", false
+	}
+
+	key, ok := w.keys[pathKey]
+	if !ok {
+		return "", false
+	}
+
+	found, lf := w.fc.QueryKey(key)
+	if !found {
+		return "", false
+	}
+
+	stale, err := lf.IsStale()
+	if err != nil {
+		log.Printf("files: watching cache: %v", err)
+		return "", false
+	}
+
+	if !stale {
+		return "", false
+	}
+
+	_, _, err = w.fc.load(&loadRequest{
+		key:       key,
+		path:      lf.Path(),
+		overwrite: true,
+		gunzip:    lf.decompressed,
+	})
+	if err != nil {
+		// Either the file is gone or we cannot read it anymore. Either way the entry is no longer a
+		// valid view of the disk.
+		w.fc.Remove(key)
+	}
+
+	return key, true
+}
@@ -0,0 +1,250 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const watchTestTimeout = 10 * time.Second
+
+// startWatch starts watching |fc|. The watch is stopped (and its channel drained) at the end of the
+// test.
+func startWatch(t *testing.T, fc *FileCache) <-chan string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := fc.Watch(ctx)
+	if err != nil {
+		cancel()
+		t.Fatalf("Watch(): %v", err)
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		for range ch {
+		}
+	})
+
+	return ch
+}
+
+// waitForEntry waits until the entry for |key| satisfies |done|, which is checked every time |key|
+// is emitted by the watch.
+func waitForEntry(t *testing.T, fc *FileCache, ch <-chan string, key string, done func(found bool, lf *LoadedFile) bool) {
+	t.Helper()
+
+	timeout := time.After(watchTestTimeout)
+	for {
+		select {
+		case got, ok := <-ch:
+			if !ok {
+				t.Fatalf("watch channel closed while waiting for %q", key)
+			}
+
+			if got == key && done(fc.QueryKey(key)) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", key)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func dataIs(want string) func(bool, *LoadedFile) bool {
+	return func(found bool, lf *LoadedFile) bool {
+		return found && string(lf.Data) == want
+	}
+}
+
+func TestWatchReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	writeTestFile(t, path, []byte("old"))
+
+	fc := NewFileCache()
+	if _, err := fc.LoadFromPath(path, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := startWatch(t, fc)
+	writeTestFile(t, path, []byte("new content"))
+	waitForEntry(t, fc, ch, path, dataIs("new content"))
+}
+
+func TestWatchReloadsDecompressed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt.gz")
+	writeTestFile(t, path, gzipped(t, "old"))
+
+	fc := NewFileCache()
+	if _, err := fc.LoadFromPathDecompressed(path, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := startWatch(t, fc)
+	writeTestFile(t, path, gzipped(t, "new content"))
+	waitForEntry(t, fc, ch, path, dataIs("new content"))
+}
+
+func TestWatchRemovedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	writeTestFile(t, path, []byte("content"))
+
+	fc := NewFileCache()
+	if _, err := fc.LoadFromPath(path, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := startWatch(t, fc)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForEntry(t, fc, ch, path, func(found bool, _ *LoadedFile) bool {
+		return !found
+	})
+}
+
+func TestWatchPicksUpAddedEntries(t *testing.T) {
+	interval := watchResyncInterval
+	watchResyncInterval = 10 * time.Millisecond
+	t.Cleanup(func() { watchResyncInterval = interval })
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first", "file.txt")
+	second := filepath.Join(dir, "second", "file.txt")
+	for _, path := range []string{first, second} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, path, []byte("old"))
+	}
+
+	fc := NewFileCache()
+	if _, err := fc.LoadFromPath(first, first, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := startWatch(t, fc)
+	if _, err := fc.LoadFromPath(second, second, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the watch some resyncs to start watching the new directory.
+	time.Sleep(20 * watchResyncInterval)
+	writeTestFile(t, second, []byte("new content"))
+	waitForEntry(t, fc, ch, second, dataIs("new content"))
+}
+
+func TestWatchStopsOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	writeTestFile(t, path, []byte("content"))
+
+	fc := NewFileCache()
+	if _, err := fc.LoadFromPath(path, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := fc.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch(): %v", err)
+	}
+	cancel()
+
+	timeout := time.After(watchTestTimeout)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("watch channel not closed after cancellation")
+		}
+	}
+}
+
+func TestWatchCanonicalKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Upper.TXT")
+	writeTestFile(t, path, []byte("old"))
+
+	// Load through a symlink, so that the key (resolved, and case-folded on darwin and windows)
+	// differs from the path used.
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Skipf("creating symlink: %v", err)
+	}
+
+	fc := NewFileCache()
+	fc.SetCanonicalKeys(true)
+
+	linkedPath := filepath.Join(link, "Upper.TXT")
+	key, err := fc.KeyForPath(linkedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := fc.LoadFromPath(key, linkedPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// |Path| keeps the real case, so that it can be used to access the file.
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lf.Path() != resolved {
+		t.Errorf("Path() = %q, want %q", lf.Path(), resolved)
+	}
+
+	ch := startWatch(t, fc)
+	writeTestFile(t, path, []byte("new content"))
+	waitForEntry(t, fc, ch, key, dataIs("new content"))
+}
+
+func TestWatchCustomKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	writeTestFile(t, path, []byte("old"))
+
+	fc := NewFileCache()
+	lf, err := fc.LoadFromPath("custom-key", path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lf.Path() != path {
+		t.Errorf("Path() = %q, want %q", lf.Path(), path)
+	}
+
+	ch := startWatch(t, fc)
+	writeTestFile(t, path, []byte("new content"))
+	waitForEntry(t, fc, ch, "custom-key", dataIs("new content"))
+}
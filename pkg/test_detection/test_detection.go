@@ -11,6 +11,9 @@ import (
 var bazelCheckOnce sync.Once
 var gRunningAsBazelTest bool
 
+var bazelRunCheckOnce sync.Once
+var gRunningAsBazelRun bool
+
 // RunningAsTest checks to see if this program is running as a test. This will return true both for
 // the `go test` case that the `bazel test` case.
 func RunningAsTest() bool {
@@ -56,3 +59,19 @@ func RunningAsBazelTest() bool {
 
 	return gRunningAsBazelTest
 }
+
+// RunningAsBazelRun returns true if the program was invoked via `bazel run`. In that case, the
+// working directory is within the runfiles tree and the workspace is available via the
+// BUILD_WORKSPACE_DIRECTORY environment variable.
+// This is mutually exclusive with |RunningAsBazelTest|.
+func RunningAsBazelRun() bool {
+	bazelRunCheckOnce.Do(func() {
+		if RunningAsBazelTest() {
+			return
+		}
+
+		gRunningAsBazelRun = os.Getenv("BUILD_WORKSPACE_DIRECTORY") != ""
+	})
+
+	return gRunningAsBazelRun
+}
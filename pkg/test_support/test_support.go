@@ -5,13 +5,20 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"testing"
 
 	"github.com/bazelbuild/rules_go/go/tools/bazel"
 	"github.com/cristiandonosoc/golib/pkg/files"
 	"github.com/cristiandonosoc/golib/pkg/test_detection"
 )
 
+// listRunfiles is a seam over |bazel.ListRunfiles|, so that the runfile matching logic can be
+// tested with synthetic runfile lists outside of Bazel.
+var listRunfiles = bazel.ListRunfiles
+
 // TestTmpDir returns a valid base string to be fed to os.MkdirTemp.
 func TestTmpBase() string {
 	// If on bazel, we use their temp dir.
@@ -70,7 +77,7 @@ func Runfiles(dir string) ([]string, error) {
 
 func bazelCandidatesRunfiles(dir string) ([]string, error) {
 	// We attempt to query Bazel to see if it can find runfiles.
-	runfiles, err := bazel.ListRunfiles()
+	runfiles, err := listRunfiles()
 	if err != nil {
 		return nil, fmt.Errorf("listing runfiles: %w", err)
 	}
@@ -91,6 +98,11 @@ func bazelCandidatesRunfiles(dir string) ([]string, error) {
 
 // RunfilePath tries to find a testdata file in a build system agnostic way, working for both Bazel
 // environments and default Go ones.
+//
+// For the default Go case, a relative path is resolved in this order:
+//  1. Relative to the current working directory.
+//  2. Relative to the directory of the source file that called into this package. This permits to
+//     find the testdata adjacent to the test even when invoked from another directory.
 func RunfilePath(path string) (string, error) {
 	if !test_detection.RunningAsTest() {
 		return "", fmt.Errorf("should only be called for tests")
@@ -98,7 +110,7 @@ func RunfilePath(path string) (string, error) {
 
 	if test_detection.RunningAsBazelTest() {
 		// We attempt to query Bazel to see if it can find runfiles.
-		runfiles, err := bazel.ListRunfiles()
+		runfiles, err := listRunfiles()
 		if err != nil {
 			return "", fmt.Errorf("listing runfiles: %w", err)
 		}
@@ -120,11 +132,123 @@ func RunfilePath(path string) (string, error) {
 	}
 
 	// If not, we attempt to find the file normally, as that would work for normal Go invocations.
-	if _, found, err := files.StatFile(path); err != nil || !found {
-		return "", fmt.Errorf("stat %q: %w (found: %t)", path, err, found)
+	_, found, err := files.StatFile(path)
+	if err != nil {
+		return "", fmt.Errorf("stat %q: %w", path, err)
+	}
+
+	if found {
+		return path, nil
+	}
+
+	// Otherwise we try relative to the source file of the caller.
+	if !filepath.IsAbs(path) {
+		if dir, ok := callerDir(); ok {
+			candidate := filepath.Join(dir, path)
+			if _, found, err := files.StatFile(candidate); err == nil && found {
+				return candidate, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("stat %q: file not found", path)
+}
+
+// SourceDir returns the directory of the source file that called into this package (typically the
+// test), which is a stable base to locate fixtures regardless of the working directory.
+// NOTE: Under Bazel the source files might not be present in the sandbox, so prefer the runfile
+// resolution (|RunfilePath|) there.
+func SourceDir() (string, error) {
+	dir, ok := callerDir()
+	if !ok {
+		return "", fmt.Errorf("could not determine the caller source file")
+	}
+
+	return dir, nil
+}
+
+// callerDir returns the directory of the source file of the first caller outside of this package.
+func callerDir() (string, bool) {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+		if frame.File != "" && !strings.HasPrefix(frame.Function, thisPackage+".") {
+			return filepath.Dir(frame.File), true
+		}
+
+		if !more {
+			return "", false
+		}
+	}
+}
+
+// thisPackage is the import path of this package, used to skip our own frames.
+const thisPackage = "github.com/cristiandonosoc/golib/pkg/test_support"
+
+// RunfileDir is like |RunfilePath|, but resolves a directory (eg. "testdata"), returning its
+// absolute path. Under Bazel the directory is derived from any runfile located within it.
+func RunfileDir(dir string) (string, error) {
+	if !test_detection.RunningAsTest() {
+		return "", fmt.Errorf("should only be called for tests")
+	}
+
+	var resolved string
+	if test_detection.RunningAsBazelTest() {
+		runfiles, err := listRunfiles()
+		if err != nil {
+			return "", fmt.Errorf("listing runfiles: %w", err)
+		}
+
+		// We look for a runfile within the directory and trim everything after the directory.
+		needle := "/" + strings.Trim(files.ToUnixPath(dir), "/") + "/"
+		for _, rf := range runfiles {
+			path := files.ToUnixPath(rf.Path)
+			if index := strings.Index(path, needle); index >= 0 {
+				resolved = filepath.FromSlash(path[:index+len(needle)-1])
+				break
+			}
+		}
+
+		if resolved == "" {
+			return "", fmt.Errorf("cannot find runfile dir %q", dir)
+		}
+	} else {
+		rp, err := RunfilePath(dir)
+		if err != nil {
+			return "", err
+		}
+		resolved = rp
+	}
+
+	abs, err := filepath.Abs(resolved)
+	if err != nil {
+		return "", fmt.Errorf("abs %q: %w", resolved, err)
+	}
+
+	isDir, err := files.DirExists(abs)
+	if err != nil {
+		return "", err
+	}
+
+	if !isDir {
+		return "", fmt.Errorf("%q is not a directory", abs)
 	}
 
-	return path, nil
+	return abs, nil
+}
+
+// RunfileHash resolves |path| (see |RunfilePath|) and returns the hex encoded sha256 of its content.
+// This is a cheap change signal for watch loops (eg. ibazel) where fixtures can change between runs.
+func RunfileHash(path string) (string, error) {
+	rp, err := RunfilePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	return files.HashFile(rp)
 }
 
 // LoadRunfile tries to read a file using the loading rules of |RunfilePath|.
@@ -140,3 +264,158 @@ func LoadRunfile(path string) (*files.LoadedFile, error) {
 
 	return files.LoadFileFromPath(rp)
 }
+
+// MustRunfilePath is like |RunfilePath|, but fails the test if the file cannot be found.
+func MustRunfilePath(tb testing.TB, path string) string {
+	tb.Helper()
+
+	rp, err := RunfilePath(path)
+	if err != nil {
+		tb.Fatalf("finding runfile %q: %v", path, err)
+	}
+
+	return rp
+}
+
+// MustLoadRunfile is like |LoadRunfile|, but fails the test if the file cannot be loaded.
+func MustLoadRunfile(tb testing.TB, path string) *files.LoadedFile {
+	tb.Helper()
+
+	lf, err := LoadRunfile(path)
+	if err != nil {
+		tb.Fatalf("loading runfile %q: %v", path, err)
+	}
+
+	return lf
+}
+
+var testFileCacheOnce sync.Once
+var gTestFileCache *files.FileCache
+
+// TestFileCache returns a cache that, unlike |files.GlobalFileCache|, is enabled under tests.
+// This is the cache used by |InMemoryFile|.
+func TestFileCache() *files.FileCache {
+	testFileCacheOnce.Do(func() {
+		gTestFileCache = files.NewFileCache()
+	})
+
+	return gTestFileCache
+}
+
+// InMemoryFile creates a disk-free loaded file with |key| in |TestFileCache|, which will be removed
+// from it once the test finishes. Any previous entry with the same key is overwritten.
+func InMemoryFile(tb testing.TB, key string, data []byte) *files.LoadedFile {
+	tb.Helper()
+
+	lf, err := TestFileCache().NewFromData(key, data, true)
+	if err != nil {
+		tb.Fatalf("creating in-memory file %q: %v", key, err)
+	}
+
+	tb.Cleanup(func() {
+		TestFileCache().Remove(key)
+	})
+
+	return lf
+}
+
+// CopyRunfileToTemp resolves |runfilePath| (see |RunfilePath|) and copies it into a temporary
+// directory under |TestTmpBase|, which is removed when the test finishes. Returns the path to the
+// writable copy. This is useful as runfiles are read-only under Bazel.
+// The execute bits are preserved, but not the rest of the mode, so the copy is always writable.
+func CopyRunfileToTemp(tb testing.TB, runfilePath string) string {
+	tb.Helper()
+
+	src := MustRunfilePath(tb, runfilePath)
+
+	dir, err := os.MkdirTemp(TestTmpBase(), "runfile-")
+	if err != nil {
+		tb.Fatalf("creating temp dir for %q: %v", runfilePath, err)
+	}
+	tb.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	dst := filepath.Join(dir, filepath.Base(src))
+	options := files.CopyFileAdvancedOptions{
+		PreserveExecutable: true,
+	}
+	if err := files.CopyFileAdvanced(src, dst, &options); err != nil {
+		tb.Fatalf("copying runfile %q: %v", runfilePath, err)
+	}
+
+	return dst
+}
+
+// SnapshotDir returns a stable textual manifest of the tree under |root|, meant to be compared
+// against a golden file. Each line is "<relative unix path> <size> <sha256>", sorted by path.
+func SnapshotDir(root string) (string, error) {
+	entries, err := files.ListFilesRecursive(root)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, entry := range entries {
+		path := filepath.Join(root, filepath.FromSlash(entry))
+
+		stat, found, err := files.StatFile(path)
+		if err != nil || !found {
+			return "", files.StatFileErrorf(err, "statting %q", path)
+		}
+
+		hash, err := files.HashFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&sb, "%s %d %s\n", entry, stat.Size(), hash)
+	}
+
+	return sb.String(), nil
+}
+
+// AssertDirsEqual compares the trees |expected| and |got| (see |files.DiffDirs|) and fails the test
+// with a report of the missing, extra and different files if they are not equal.
+func AssertDirsEqual(tb testing.TB, expected, got string) {
+	tb.Helper()
+	AssertDirsEqualAdvanced(tb, expected, got, nil)
+}
+
+// AssertDirsEqualAdvanced is like |AssertDirsEqual|, but the files are compared following |options|
+// (eg. ignoring line endings for golden files checked out on Windows).
+func AssertDirsEqualAdvanced(tb testing.TB, expected, got string, options *files.CompareOptions) {
+	tb.Helper()
+
+	diff, err := files.DiffDirsAdvanced(expected, got, options)
+	if err != nil {
+		tb.Fatalf("comparing dirs %q and %q: %v", expected, got, err)
+	}
+
+	if diff.Equal() {
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "dirs differ (expected %q, got %q):", expected, got)
+	sections := []struct {
+		title string
+		paths []string
+	}{
+		{"missing", diff.OnlyInA},
+		{"extra", diff.OnlyInB},
+		{"different", diff.Different},
+	}
+	for _, section := range sections {
+		if len(section.paths) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&sb, "\n  %s:", section.title)
+		for _, path := range section.paths {
+			fmt.Fprintf(&sb, "\n    %s", path)
+		}
+	}
+
+	tb.Error(sb.String())
+}